@@ -0,0 +1,218 @@
+// Copyright (C) 2018 Michael J. Fromberger. All Rights Reserved.
+
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/creachadair/atomicfile"
+	"github.com/creachadair/mds/mapset"
+	"github.com/creachadair/tarsnap"
+)
+
+// Bytes is a storage size in bytes. In the configuration file it is written
+// as a number with an optional unit suffix K, M, G, or T (with or without a
+// trailing "B" or "iB"), denoting powers of 1024, for example "500M" or
+// "1.5 GiB".
+type Bytes int64
+
+// bx matches a size, after conversion to upper case.
+var bx = regexp.MustCompile(`^(\d+|\d*\.\d+) ?([KMGT]?)(IB|B)?$`)
+
+func parseBytes(s string) (Bytes, error) {
+	m := bx.FindStringSubmatch(strings.ToUpper(strings.TrimSpace(s)))
+	if m == nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	f, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number: %v", err)
+	}
+	shift := 0
+	if m[2] != "" {
+		shift = strings.Index("KMGT", m[2]) + 1
+	}
+	return Bytes(f * float64(int64(1)<<(10*shift))), nil
+}
+
+// UnmarshalYAML decodes a size from a string or number.
+func (b *Bytes) UnmarshalYAML(unmarshal func(any) error) error {
+	var raw string
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+	v, err := parseBytes(raw)
+	if err != nil {
+		return err
+	}
+	*b = v
+	return nil
+}
+
+// String renders b with a binary unit suffix.
+func (b Bytes) String() string {
+	for i := 4; i > 0; i-- {
+		if unit := int64(1) << (10 * i); int64(b) >= unit {
+			v := math.Round(10*float64(b)/float64(unit)) / 10
+			return strconv.FormatFloat(v, 'f', -1, 64) + "KMGT"[i-1:i]
+		}
+	}
+	return strconv.FormatInt(int64(b), 10)
+}
+
+// LoadSizes makes the storage sizes of the archives in arch available to
+// budget rules. Sizes are read from the size cache file, if one is set, and
+// sizes not found there are fetched from tarsnap and added to the cache.
+// Archives not in arch are removed from the cache.
+func (c *Config) LoadSizes(arch []tarsnap.Archive) error {
+	sizes := make(map[string]*tarsnap.Sizes)
+	if c.SizeCache != "" {
+		data, err := os.ReadFile(c.SizeCache)
+		if err == nil {
+			err = json.Unmarshal(data, &sizes)
+		} else if errors.Is(err, fs.ErrNotExist) {
+			err = nil
+		}
+		if err != nil {
+			return fmt.Errorf("loading size cache: %w", err)
+		}
+	}
+
+	live := mapset.New[string]()
+	var missing []string
+	for _, a := range arch {
+		live.Add(a.Name)
+		if sizes[a.Name] == nil {
+			missing = append(missing, a.Name)
+		}
+	}
+	for name := range sizes {
+		if !live.Has(name) {
+			delete(sizes, name)
+		}
+	}
+	if len(missing) != 0 {
+		c.logf("Fetching sizes for %d archives", len(missing))
+		info, err := c.Config.Size(missing...)
+		if err != nil {
+			return fmt.Errorf("fetching sizes: %w", err)
+		}
+		for name, s := range info.Archive {
+			sizes[name] = s
+		}
+	}
+	c.sizes = sizes
+
+	if c.SizeCache == "" {
+		return nil
+	}
+	bits, err := json.Marshal(sizes)
+	if err != nil {
+		return fmt.Errorf("encoding size cache: %v", err)
+	} else if err := os.MkdirAll(filepath.Dir(c.SizeCache), 0700); err != nil {
+		return fmt.Errorf("creating size cache directory: %v", err)
+	} else if err := atomicfile.WriteData(c.SizeCache, bits, 0600); err != nil {
+		return fmt.Errorf("writing size cache: %v", err)
+	}
+	return nil
+}
+
+// ArchiveSize returns the storage sizes of the named archive loaded by
+// LoadSizes, or nil if they are not known.
+func (c *Config) ArchiveSize(name string) *tarsnap.Sizes { return c.sizes[name] }
+
+// HasBudget reports whether any backup set has a budget rule.
+func (c *Config) HasBudget() bool {
+	for _, b := range c.Backup {
+		if budgetOf(c.findPolicy(b)) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// BudgetArchives returns the archives in arch that belong to backup sets with
+// a budget rule. Only their sizes need to be loaded by LoadSizes.
+func (c *Config) BudgetArchives(arch []tarsnap.Archive) []tarsnap.Archive {
+	var out []tarsnap.Archive
+	for _, a := range arch {
+		if b := c.FindSet(a.Base); b != nil && budgetOf(c.findPolicy(b)) > 0 {
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+// budgetOf returns the smallest budget of the rules in exp, or 0 if there
+// are no budget rules.
+func budgetOf(exp []*Policy) Bytes {
+	var min Bytes
+	for _, p := range exp {
+		if p.Budget > 0 && (min == 0 || p.Budget < min) {
+			min = p.Budget
+		}
+	}
+	return min
+}
+
+// applyBudget returns the archives of set (ordered oldest to newest) to be
+// deleted so that the estimated storage of the set fits within budget, given
+// that the archives in expired are already to be deleted. Pinned archives and
+// the newest archive are never chosen; otherwise the oldest go first.
+//
+// The storage of the set is estimated as the compressed size of its newest
+// archive, plus the compressed unique bytes of each other retained archive.
+// Deleting an archive is estimated to free its compressed unique bytes.
+func (c *Config) applyBudget(set []tarsnap.Archive, expired []tarsnap.Archive, budget Bytes) []tarsnap.Archive {
+	if len(set) == 0 {
+		return nil
+	}
+	drop := mapset.New[string]()
+	for _, a := range expired {
+		drop.Add(a.Name)
+	}
+	newest := set[len(set)-1]
+	ns := c.ArchiveSize(newest.Name)
+	if ns == nil {
+		c.logf("No size known for %q; skipping budget %v", newest.Name, budget)
+		return nil
+	}
+	total := ns.CompressedBytes
+	for _, a := range set[:len(set)-1] {
+		if s := c.ArchiveSize(a.Name); s != nil && !drop.Has(a.Name) {
+			total += s.CompressedUniqueBytes
+		}
+	}
+	c.logf(":: budget %v, estimated size %v", budget, Bytes(total))
+
+	var out []tarsnap.Archive
+	for _, a := range set[:len(set)-1] {
+		if total <= int64(budget) {
+			break
+		} else if drop.Has(a.Name) || c.IsPinned(a.Name) {
+			continue
+		}
+		s := c.ArchiveSize(a.Name)
+		if s == nil {
+			c.logf("+ keep %q, size unknown", a.Name)
+			continue
+		}
+		total -= s.CompressedUniqueBytes
+		out = append(out, a)
+		c.logf("- drop %q by budget %v, frees %v [estimate now %v]",
+			a.Name, budget, Bytes(s.CompressedUniqueBytes), Bytes(total))
+	}
+	if total > int64(budget) {
+		c.logf("Warning: estimated size %v still exceeds budget %v", Bytes(total), budget)
+	}
+	return out
+}
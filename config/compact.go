@@ -0,0 +1,202 @@
+// Copyright (C) 2018 Michael J. Fromberger. All Rights Reserved.
+
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Rules is a list of expiration rules. In the configuration file, it may be
+// written either as a list of rules, or as a single string in the compact
+// syntax accepted by ParseRules.
+type Rules []*Policy
+
+// UnmarshalYAML decodes rules from a list of rules or a compact string.
+func (r *Rules) UnmarshalYAML(unmarshal func(any) error) error {
+	var s string
+	if err := unmarshal(&s); err == nil {
+		rs, err := ParseRules(s)
+		if err != nil {
+			return err
+		}
+		*r = rs
+		return nil
+	}
+	var ps []*Policy
+	if err := unmarshal(&ps); err != nil {
+		return err
+	}
+	*r = ps
+	return nil
+}
+
+// String renders r in the compact syntax accepted by ParseRules.
+func (r Rules) String() string { return FormatRules(r) }
+
+// ParseRules parses a list of expiration rules in compact syntax, for example:
+//
+//	latest 3; 1d..2w 1/day; 2w..6mo 1/week; >6mo none
+//
+// Rules are separated by semicolons. Each rule begins with an optional window
+// of archive ages to which it applies, one of:
+//
+//	A..B  -- after A and until B
+//	>A    -- after A (also written A..)
+//	<B    -- until B (also written ..B)
+//
+// where A and B are intervals without spaces, such as "36h", "2w", or "6mo".
+// A rule without a window applies to archives of any age. The window is
+// followed by any of these settings, separated by spaces:
+//
+//	latest N       -- keep the N most recent archives (the "latest" setting)
+//	N/INTERVAL     -- sample N archives per interval, e.g., "1/day"
+//	none, all      -- keep no archives, or all archives
+//	keep-daily N   -- and likewise keep-last, keep-hourly, keep-weekly, etc.
+//	budget SIZE    -- a budget rule, e.g., "budget 20G"
+//
+// The resulting rules are sorted into the same order as other rules.
+func ParseRules(s string) (Rules, error) {
+	var out Rules
+	for _, text := range strings.Split(s, ";") {
+		words := strings.Fields(text)
+		if len(words) == 0 {
+			continue
+		}
+		p := new(Policy)
+		if ok, err := p.parseWindow(words[0]); err != nil {
+			return nil, fmt.Errorf("rule %q: %w", strings.TrimSpace(text), err)
+		} else if ok {
+			words = words[1:]
+		}
+		for len(words) != 0 {
+			n, err := p.parseSetting(words)
+			if err != nil {
+				return nil, fmt.Errorf("rule %q: %w", strings.TrimSpace(text), err)
+			}
+			words = words[n:]
+		}
+		out = append(out, p)
+	}
+	sortExp(out)
+	if err := checkExp(out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// parseWindow parses s as the age window of p, and reports whether s is a
+// window.
+func (p *Policy) parseWindow(s string) (bool, error) {
+	var lo, hi string
+	if t, ok := strings.CutPrefix(s, ">"); ok {
+		lo = t
+	} else if t, ok := strings.CutPrefix(s, "<"); ok {
+		hi = t
+	} else if a, b, ok := strings.Cut(s, ".."); ok {
+		lo, hi = a, b
+	} else {
+		return false, nil
+	}
+	if lo == "" && hi == "" {
+		return false, fmt.Errorf("empty window %q", s)
+	}
+	var err error
+	if lo != "" {
+		if p.Min, err = parseInterval(lo); err != nil {
+			return false, err
+		}
+	}
+	if hi != "" {
+		if p.Max, err = parseInterval(hi); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// parseSetting parses a setting of p from the beginning of words, and returns
+// the number of words consumed.
+func (p *Policy) parseSetting(words []string) (int, error) {
+	arg := func() (int, error) {
+		if len(words) < 2 {
+			return 0, fmt.Errorf("missing value for %q", words[0])
+		}
+		n, err := strconv.Atoi(words[1])
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid count %q for %q", words[1], words[0])
+		}
+		return n, nil
+	}
+	var err error
+	switch w := words[0]; w {
+	case "latest":
+		p.Latest, err = arg()
+	case "budget":
+		if len(words) < 2 {
+			return 0, fmt.Errorf("missing value for %q", w)
+		}
+		p.Budget, err = parseBytes(words[1])
+	case "keep-last":
+		p.Keep.Last, err = arg()
+	case "keep-hourly":
+		p.Keep.Hourly, err = arg()
+	case "keep-daily":
+		p.Keep.Daily, err = arg()
+	case "keep-weekly":
+		p.Keep.Weekly, err = arg()
+	case "keep-monthly":
+		p.Keep.Monthly, err = arg()
+	case "keep-yearly":
+		p.Keep.Yearly, err = arg()
+	default:
+		if p.Sample != nil {
+			return 0, fmt.Errorf("unexpected %q", w)
+		}
+		p.Sample = new(Sampling)
+		if err := p.Sample.parseFrom(w); err != nil {
+			return 0, err
+		}
+		return 1, nil
+	}
+	return 2, err
+}
+
+// FormatRules renders rs in the compact syntax accepted by ParseRules.
+func FormatRules(rs []*Policy) string {
+	parts := make([]string, len(rs))
+	for i, p := range rs {
+		parts[i] = p.String()
+	}
+	return strings.Join(parts, "; ")
+}
+
+// String renders p as a single rule in the syntax accepted by ParseRules.
+func (p *Policy) String() string {
+	var words []string
+	switch {
+	case p.Min > 0 && p.Max > 0 && p.Max != forever:
+		words = append(words, p.Min.String()+".."+p.Max.String())
+	case p.Min > 0:
+		words = append(words, ">"+p.Min.String())
+	case p.Max > 0 && p.Max != forever:
+		words = append(words, "<"+p.Max.String())
+	}
+	if p.Budget > 0 {
+		words = append(words, "budget", p.Budget.String())
+	}
+	if p.Latest > 0 {
+		words = append(words, "latest", strconv.Itoa(p.Latest))
+	}
+	if p.Sample != nil {
+		words = append(words, p.Sample.String())
+	}
+	if p.Keep.IsSet() {
+		words = append(words, p.Keep.String())
+	}
+	if len(words) == 0 {
+		return "none" // a rule with no settings discards everything
+	}
+	return strings.Join(words, " ")
+}
@@ -10,6 +10,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strings"
 	"time"
@@ -28,10 +29,10 @@ type Config struct {
 	Backup []*Backup
 
 	// Default expiration policies.
-	Expiration []*Policy
+	Expiration Rules
 
 	// Named expiration policy sets.
-	Policy map[string][]*Policy
+	Policy map[string]Rules
 
 	// Enable verbose logging.
 	Verbose bool
@@ -43,6 +44,57 @@ type Config struct {
 	ListCache  string     `json:"listCache" yaml:"list-cache"`
 	cachedList *ListCache // non-nil when populated
 
+	// If set, create an archive with this base name alongside each batch of
+	// backups, recording the settings in effect (see Manifest).
+	Manifest string `json:"manifest,omitempty"`
+
+	// Default safety limits on pruning (see PruneLimits).
+	PruneLimits PruneLimits `json:"pruneLimits" yaml:"prune-limits"`
+
+	// If "newest", compute the ages of archives for expiration relative to
+	// the newest archive of each set, rather than the current time. The
+	// default, "now", uses the current time.
+	PruneAnchor string `json:"pruneAnchor,omitempty" yaml:"prune-anchor"`
+
+	// If positive, refuse to prune when the current time is later than the
+	// newest archive by more than this interval, suggesting a bad clock.
+	MaxClockSkew Interval `json:"maxClockSkew,omitempty" yaml:"max-clock-skew"`
+
+	// If positive, archives expired by pruning are first marked for deletion
+	// in the pending file, and only deleted by a later prune once they have
+	// been pending this long and are still expired.
+	PruneGrace  Interval `json:"pruneGrace,omitempty" yaml:"prune-grace"`
+	PendingFile string   `json:"pendingFile,omitempty" yaml:"pending-file"`
+
+	// Ask for confirmation before pruning, even when not run interactively
+	// from a terminal, or when auto-pruning.
+	ConfirmPrune bool `json:"confirmPrune,omitempty" yaml:"confirm-prune"`
+
+	// If true, expiration rules that sample once per hour, day, week, month,
+	// or year keep the latest archive in each calendar period, rather than in
+	// fixed-width intervals from the Unix epoch. Weeks are ISO 8601 weeks.
+	CalendarSampling bool `json:"calendarSampling,omitempty" yaml:"calendar-sampling"`
+
+	// The name of the time zone for calendar periods in expiration rules, such
+	// as "America/Los_Angeles". The default is the local time zone.
+	TimeZone string         `json:"timeZone,omitempty" yaml:"time-zone"`
+	loc      *time.Location // non-nil when TimeZone is set
+
+	// Cache the storage sizes of archives, used by budget rules, in this file.
+	SizeCache string                    `json:"sizeCache,omitempty" yaml:"size-cache"`
+	sizes     map[string]*tarsnap.Sizes // populated by LoadSizes
+
+	// Archives that must never be pruned, in addition to those pinned in the
+	// pin file (see LoadPins).
+	Pinned []string `json:"pinned,omitempty"`
+
+	// Record archives pinned from the command line in this file.
+	PinFile string    `json:"pinFile,omitempty" yaml:"pin-file"`
+	pins    *PinStore // non-nil when loaded
+
+	// Record the results of restore drills in this file.
+	DrillHistory string `json:"drillHistory,omitempty" yaml:"drill-history"`
+
 	// Auto-prune settings.
 	AutoPrune struct {
 		Timestamp string   // timestamp file
@@ -55,8 +107,15 @@ type Config struct {
 
 // A BackupPath describes a path relative to a particular backup.
 type BackupPath struct {
-	Relative string  `json:"relative"`
-	Backup   *Backup `json:"backup"`
+	// The path of the file, either absolute or relative to the working
+	// directory of the backup, after applying the substitution rules of the
+	// backup. Unlike Archive, a leading "/" is not removed.
+	Relative string `json:"relative"`
+
+	// The name of the entry for the file in archives of the backup.
+	Archive string `json:"archive"`
+
+	Backup *Backup `json:"backup"`
 }
 
 // FindPath reports the backups that claim path, or nil if there are none.
@@ -71,22 +130,9 @@ func (c *Config) FindPath(path string) []BackupPath {
 		if !ok {
 			continue
 		}
-
-		// Apply any modification rules to the path, so that the caller gets the
-		// name that occurs in the backup set.
-		for _, m := range b.Modify {
-			r, err := tarsnap.ParseRule(m)
-			if err != nil {
-				log.Printf("Warning: invalid substitution rule %#q: %v [ignored]", m, err)
-				continue
-			}
-			if s, ok := r.Apply(rel); ok {
-				rel = s
-				break
-			}
-		}
 		out = append(out, BackupPath{
-			Relative: rel,
+			Relative: b.modifyPath(rel),
+			Archive:  b.ArchiveName(rel),
 			Backup:   b,
 		})
 	}
@@ -168,6 +214,10 @@ func (c *Config) findPolicy(b *Backup) []*Policy {
 	}
 }
 
+// EffectiveRules returns the expiration rules in effect for b, taking into
+// account its named policy and the default rules.
+func (c *Config) EffectiveRules(b *Backup) Rules { return c.findPolicy(b) }
+
 func (c *Config) checkPolicy(b *Backup) bool {
 	if b.Policy == "" {
 		return true
@@ -178,7 +228,13 @@ func (c *Config) checkPolicy(b *Backup) bool {
 
 // FindExpired returns a slice of the archives in arch that are eligible for
 // removal under the expiration policies in effect for c, given that now is the
-// moment denoting the present.
+// moment denoting the present. Pinned archives are never eligible.
+//
+// If the prune anchor is "newest", the ages of the archives of each set are
+// computed relative to the newest archive of that set rather than now.
+//
+// Budget rules are applied after the other rules, using the archive sizes
+// loaded by LoadSizes. If sizes have not been loaded, budgets are ignored.
 func (c *Config) FindExpired(arch []tarsnap.Archive, now time.Time) []tarsnap.Archive {
 	c.logf("Finding expired archives, %d inputs, current time %v", len(arch), now)
 
@@ -196,19 +252,27 @@ func (c *Config) FindExpired(arch []tarsnap.Archive, now time.Time) []tarsnap.Ar
 	var match []tarsnap.Archive
 	for _, b := range c.Backup {
 		exp := c.findPolicy(b)
-		if len(exp) == 0 {
+		budget := budgetOf(exp)
+		exp = slices.DeleteFunc(slices.Clone(exp), func(p *Policy) bool { return p.Budget > 0 })
+		if len(exp) == 0 && budget == 0 {
 			c.logf("No expiration rules for %s [skipping]", b.Name)
 			continue // nothing to do
 		}
 		c.logf("Applying %d expiration rules for %s", len(exp), b.Name)
 
+		ref := now
+		if n := len(sets[b.Name]); n != 0 && c.PruneAnchor == "newest" {
+			ref = sets[b.Name][n-1].Created
+			c.logf("Anchoring ages for %s to %q [%v]", b.Name, sets[b.Name][n-1].Name, ref)
+		}
+
 		// Now, find all the archives belonging this backup which are affected by
 		// some rule, and record which if any rule applies. If no rule applies,
 		// the archive is kept unconditionally. The slice for each rule is in
 		// order by creation date (oldest to newest).
 		rules := make(map[*Policy][]tarsnap.Archive)
 		for _, a := range sets[b.Name] {
-			age := durationInterval(now.Sub(a.Created))
+			age := durationInterval(ref.Sub(a.Created))
 			for _, rule := range exp {
 				if rule.Min <= age && (rule.Max == 0 || rule.Max >= age) {
 					rules[rule] = append(rules[rule], a)
@@ -218,10 +282,21 @@ func (c *Config) FindExpired(arch []tarsnap.Archive, now time.Time) []tarsnap.Ar
 		}
 
 		// Finally, apply the policy...
+		var drop []tarsnap.Archive
 		for rule, batch := range rules {
 			c.logf(":: %v (%d candidates)", rule, len(batch))
-			match = append(match, rule.apply(c, batch)...)
+			drop = append(drop, rule.apply(c, batch)...)
+		}
+		drop = c.keepPinned(drop)
+		if budget > 0 && c.sizes == nil {
+			c.logf("Archive sizes are not loaded; skipping budget %v", budget)
+		} else if budget > 0 {
+			drop = append(drop, c.applyBudget(sets[b.Name], drop, budget)...)
 		}
+		match = append(match, drop...)
+	}
+	if c.Manifest != "" {
+		match = append(match, c.keepPinned(c.expiredManifests(arch, match))...)
 	}
 	return match
 }
@@ -271,6 +346,14 @@ func (c *Config) ensurePruneSentinel() (time.Time, error) {
 	return fi.ModTime(), err
 }
 
+// location returns the time zone for calendar periods.
+func (c *Config) location() *time.Location {
+	if c.loc != nil {
+		return c.loc
+	}
+	return time.Local
+}
+
 func (c *Config) logf(msg string, args ...any) {
 	if c.Verbose {
 		log.Printf(msg, args...)
@@ -284,7 +367,7 @@ type Backup struct {
 	Name string `json:"name"`
 
 	// Expiration policies.
-	Expiration []*Policy `json:"expiration,omitempty"`
+	Expiration Rules `json:"expiration,omitempty"`
 
 	// Named expiration policy. If no policy is named, any explicit rules are
 	// used and the default rules are ignored. Otherwise any explicit rules are
@@ -297,6 +380,9 @@ type Backup struct {
 	// Any other name uses the rules from that policy.
 	Policy string `json:"policy,omitempty"`
 
+	// Safety limits on pruning this backup, overriding the defaults.
+	PruneLimits *SetPruneLimits `json:"pruneLimits,omitempty" yaml:"prune-limits"`
+
 	// Expand shell globs in included paths.
 	GlobIncludes bool `json:"globIncludes" yaml:"glob-includes"`
 
@@ -308,6 +394,15 @@ type Backup struct {
 	tarsnap.CreateOptions `yaml:",inline"`
 }
 
+// Dir returns the working directory of b, given that wd is the default
+// working directory for backups that do not specify their own.
+func (b *Backup) Dir(wd string) string {
+	if b.WorkDir == "" {
+		return wd
+	}
+	return b.WorkDir
+}
+
 // ExpandIncludes performs glob expansion on the include paths of b relative to
 // the given working directory, replacing the paths with their expansion.
 // If GlobIncludes is false, the include paths are not modified.
@@ -315,10 +410,7 @@ func (b *Backup) ExpandIncludes(wd string) {
 	if !b.GlobIncludes {
 		return
 	}
-	base := b.WorkDir
-	if base == "" {
-		base = wd
-	}
+	base := b.Dir(wd)
 	vpath := func(inc string) string {
 		if filepath.IsAbs(inc) {
 			return inc
@@ -349,11 +441,18 @@ func Parse(r io.Reader) (*Config, error) {
 		return nil, err
 	}
 	sortExp(cfg.Expiration)
+	if err := checkExp(cfg.Expiration); err != nil {
+		return nil, fmt.Errorf("expiration: %w", err)
+	}
 	expand(&cfg.Keyfile)
 	expand(&cfg.WorkDir)
 	expand(&cfg.CacheDir)
 	expand(&cfg.ListCache)
 	expand(&cfg.AutoPrune.Timestamp)
+	expand(&cfg.DrillHistory)
+	expand(&cfg.PinFile)
+	expand(&cfg.PendingFile)
+	expand(&cfg.SizeCache)
 
 	seen := mapset.New[string]()
 	for _, b := range cfg.Backup {
@@ -365,13 +464,37 @@ func Parse(r io.Reader) (*Config, error) {
 			return nil, fmt.Errorf("undefined policy %q for backup %q", b.Policy, b.Name)
 		}
 		seen.Add(b.Name)
+		if b.Name == cfg.Manifest {
+			return nil, fmt.Errorf("backup name %q is reserved for the manifest", b.Name)
+		}
 		sortExp(b.Expiration)
+		if err := checkExp(b.Expiration); err != nil {
+			return nil, fmt.Errorf("backup %q: %w", b.Name, err)
+		}
 		expand(&b.WorkDir)
 		// N.B. Glob expansion is deferred until we know whether we are creating
 		// backups or just examining the configuration.
 	}
-	for _, named := range cfg.Policy {
+	for name, named := range cfg.Policy {
 		sortExp(named)
+		if err := checkExp(named); err != nil {
+			return nil, fmt.Errorf("policy %q: %w", name, err)
+		}
+	}
+	if cfg.TimeZone != "" {
+		loc, err := time.LoadLocation(cfg.TimeZone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid time-zone: %w", err)
+		}
+		cfg.loc = loc
+	}
+	if cfg.PruneGrace > 0 && cfg.PendingFile == "" {
+		return nil, errors.New("prune-grace requires a pending-file")
+	}
+	switch cfg.PruneAnchor {
+	case "", "now", "newest":
+	default:
+		return nil, fmt.Errorf("invalid prune-anchor %q (want now or newest)", cfg.PruneAnchor)
 	}
 	return &cfg, nil
 }
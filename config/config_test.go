@@ -3,10 +3,15 @@
 package config
 
 import (
+	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
+	_ "time/tzdata" // for TestCalendarSampling
 
+	"github.com/creachadair/mds/mapset"
 	"github.com/creachadair/tarsnap"
 	"github.com/google/go-cmp/cmp"
 )
@@ -57,7 +62,7 @@ func TestPolicyOrder(t *testing.T) {
 func TestPolicyAssignment(t *testing.T) {
 	cfg := &Config{
 		Expiration: []*Policy{{Latest: 1}},
-		Policy: map[string][]*Policy{
+		Policy: map[string]Rules{
 			"named":   {{Latest: 2}},
 			"default": {{Latest: 666}}, // should not be assigned
 		},
@@ -185,6 +190,30 @@ func TestFindPath(t *testing.T) {
 	}
 }
 
+func TestFindPathNames(t *testing.T) {
+	cfg := &Config{
+		Backup: []*Backup{{
+			Name: "docs",
+			CreateOptions: tarsnap.CreateOptions{
+				Include: []string{"/home/rooty/docs"},
+				Modify:  []string{`/rooty/root/`},
+			},
+		}},
+		Config: tarsnap.Config{WorkDir: "/var/tmp"},
+	}
+	got := cfg.FindPath("/home/rooty/docs/a.txt")
+	if len(got) != 1 {
+		t.Fatalf("FindPath: got %d results, want 1", len(got))
+	}
+	// The relative path has substitutions applied, but keeps its leading "/".
+	if want := "/home/root/docs/a.txt"; got[0].Relative != want {
+		t.Errorf("Relative: got %q, want %q", got[0].Relative, want)
+	}
+	if want := "home/root/docs/a.txt"; got[0].Archive != want {
+		t.Errorf("Archive: got %q, want %q", got[0].Archive, want)
+	}
+}
+
 func TestFindSet(t *testing.T) {
 	cfg := &Config{
 		Backup: []*Backup{
@@ -240,3 +269,674 @@ func TestParseSampling(t *testing.T) {
 		}
 	}
 }
+
+func TestSelector(t *testing.T) {
+	at := func(s string) time.Time {
+		t, err := time.ParseInLocation("2006-01-02T15:04", s, time.Local)
+		if err != nil {
+			panic(err)
+		}
+		return t.In(time.UTC)
+	}
+	as := tarsnap.Archives{
+		{Name: "docs.1", Base: "docs", Tag: ".1", Created: at("2024-02-28T10:00")},
+		{Name: "pics.1", Base: "pics", Tag: ".1", Created: at("2024-02-29T12:00")},
+		{Name: "docs.2", Base: "docs", Tag: ".2", Created: at("2024-03-01T09:00")},
+		{Name: "docs.3", Base: "docs", Tag: ".3", Created: at("2024-03-01T18:00")},
+		{Name: "docs.4", Base: "docs", Tag: ".4", Created: at("2024-03-05T08:00")},
+		{Name: "pics.2", Base: "pics", Tag: ".2", Created: at("2024-03-05T09:00")},
+	}
+	now := at("2024-03-06T00:00")
+
+	tests := []struct {
+		input, want string // want == "" means an error
+	}{
+		{"docs@latest", "docs.4"},
+		{"pics@latest", "pics.2"},
+		{"docs~1", "docs.4"},
+		{"docs~2", "docs.3"},
+		{"docs~4", "docs.1"},
+		{"docs~5", ""},
+		{"docs@2024-03-01", "docs.3"},
+		{"docs@2024-03-01T12:00:00", "docs.2"},
+		{"docs@2024-02-01", ""},
+		{"docs@-3d", "docs.3"},
+		{"pics@-5d", "pics.1"},
+		{"pics@-1w", ""},
+		{"docs.2", "docs.2"},
+		{"nonesuch.1", ""},
+		{"nonesuch@latest", ""},
+		{"@latest", ""}, // no set name
+	}
+	for _, test := range tests {
+		sel, err := ParseSelector(test.input)
+		if err != nil {
+			t.Errorf("ParseSelector(%q) failed: %v", test.input, err)
+			continue
+		}
+		got, err := sel.Resolve(as, now)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("Resolve(%q): got %q, want error", test.input, got.Name)
+			}
+		} else if err != nil {
+			t.Errorf("Resolve(%q) failed: %v", test.input, err)
+		} else if got.Name != test.want {
+			t.Errorf("Resolve(%q): got %q, want %q", test.input, got.Name, test.want)
+		}
+	}
+
+	for _, bad := range []string{"docs~0", "docs~x", "docs@yesterday", "docs@-3 fortnights"} {
+		if sel, err := ParseSelector(bad); err == nil {
+			t.Errorf("ParseSelector(%q): got %+v, want error", bad, sel)
+		}
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	now := time.Date(2024, 3, 6, 12, 30, 0, 0, time.UTC)
+	tests := []struct {
+		input string
+		want  time.Time
+	}{
+		{"now", now},
+		{"2024-03-01T15:04:05", time.Date(2024, 3, 1, 15, 4, 5, 0, time.Local)},
+		{"2024-03-01T15:04:05Z", time.Date(2024, 3, 1, 15, 4, 5, 0, time.UTC)},
+		{"2024-03-01T15:04:05-08:00", time.Date(2024, 3, 1, 23, 4, 5, 0, time.UTC)},
+		{"2024-03-01", time.Date(2024, 3, 1, 0, 0, 0, 0, time.Local)},
+		{"-2w", now.AddDate(0, 0, -14)},
+		{"-36h", now.Add(-36 * time.Hour)},
+		{"3 days ago", now.AddDate(0, 0, -3)},
+		{"1 hour ago", now.Add(-time.Hour)},
+	}
+	for _, test := range tests {
+		got, err := ParseTime(test.input, now)
+		if err != nil {
+			t.Errorf("ParseTime(%q) failed: %v", test.input, err)
+		} else if !got.Equal(test.want) {
+			t.Errorf("ParseTime(%q): got %v, want %v", test.input, got, test.want)
+		}
+	}
+
+	for _, bad := range []string{"", "yesterday", "2024-13-01", "-2 fortnights", "ago"} {
+		if got, err := ParseTime(bad, now); err == nil {
+			t.Errorf("ParseTime(%q): got %v, want error", bad, got)
+		}
+	}
+}
+
+func TestPathMapping(t *testing.T) {
+	plain := &Backup{
+		Name: "plain",
+		CreateOptions: tarsnap.CreateOptions{
+			Include: []string{"docs", "/usr/local/bin"},
+		},
+	}
+	modified := &Backup{
+		Name: "modified",
+		CreateOptions: tarsnap.CreateOptions{
+			Include: []string{"docs", "pics", "src", "/etc"},
+			Modify: []string{
+				`/^src/src-old/`,     // literal, anchored: reversible
+				`/^docs/documents/`,  // literal, anchored: reversible
+				`/\.jpeg$/.jpg/`,     // literal, anchored: reversible
+				`/^\.hidden$/shown/`, // literal, fully anchored
+				`/^\.//`,             // empty replacement: not reversible
+				`/\(x*\)y/\1z/`,      // not literal: not reversible
+				`/-draft/-final/g`,   // literal, global: reversible
+			},
+		},
+	}
+	preserved := &Backup{
+		Name: "preserved",
+		CreateOptions: tarsnap.CreateOptions{
+			Include:       []string{"/var/log"},
+			PreservePaths: true,
+		},
+	}
+
+	tests := []struct {
+		b           *Backup
+		local, name string
+		back        string // if different from local
+		ok          bool
+	}{
+		// Without substitutions, only leading slashes are affected.
+		{plain, "docs/a.txt", "docs/a.txt", "", true},
+		{plain, "/usr/local/bin/tool", "usr/local/bin/tool", "", true},
+		{modified, "/etc/hosts", "etc/hosts", "", true},
+
+		// Literal substitutions are reversible, if the result is unambiguous.
+		{modified, "src/a.go", "src-old/a.go", "", true},
+
+		// A name that could be either a renamed path or the same path unmodified
+		// is ambiguous, and not reversed.
+		{modified, "docs/a.txt", "documents/a.txt", "documents/a.txt", false},
+		{modified, "documents/a.txt", "documents/a.txt", "", false},
+		{modified, "pics/cat.jpeg", "pics/cat.jpg", "pics/cat.jpg", false},
+		{modified, "pics/a-draft.txt", "pics/a-final.txt", "pics/a-final.txt", false},
+		{modified, "pics/a-final.txt", "pics/a-final.txt", "", false},
+		{modified, ".hidden", "shown", "shown", false},
+
+		// Paths not affected by any rule map to themselves.
+		{modified, "pics/cat.png", "pics/cat.png", "", true},
+
+		// Deletions and non-literal rules cannot be reversed, but the result
+		// is also a plausible local name.
+		{modified, ".profile", "profile", "profile", true},
+		{modified, "pics/xxy", "pics/xxz", "pics/xxz", true},
+
+		// A name that no local path maps to.
+		{modified, "", "docs/a.txt", "docs/a.txt", false},
+
+		// With preserve-paths, absolute paths are kept intact.
+		{preserved, "/var/log/messages", "/var/log/messages", "", true},
+	}
+	for _, test := range tests {
+		if test.local != "" {
+			if got := test.b.ArchiveName(test.local); got != test.name {
+				t.Errorf("%s: ArchiveName(%q): got %q, want %q", test.b.Name, test.local, got, test.name)
+			}
+		}
+		want := test.back
+		if want == "" {
+			want = test.local
+		}
+		got, ok := test.b.LocalName(test.name)
+		if got != want || ok != test.ok {
+			t.Errorf("%s: LocalName(%q): got %q, %v; want %q, %v", test.b.Name, test.name, got, ok, want, test.ok)
+		}
+	}
+}
+
+func TestExpiredManifests(t *testing.T) {
+	cfg := &Config{Manifest: "_meta"}
+	mk := func(base, tag string) tarsnap.Archive {
+		return tarsnap.Archive{Name: base + tag, Base: base, Tag: tag}
+	}
+	arch := []tarsnap.Archive{
+		mk("docs", ".1"), mk("pics", ".1"), mk("_meta", ".1"),
+		mk("docs", ".2"), mk("_meta", ".2"),
+		mk("pics", ".3"), mk("_meta", ".3"),
+		mk("docs", ".4"), mk("_meta", ".4"),
+	}
+	expired := []tarsnap.Archive{mk("docs", ".1"), mk("docs", ".2"), mk("pics", ".3"), mk("docs", ".4")}
+
+	var got []string
+	for _, a := range cfg.expiredManifests(arch, expired) {
+		got = append(got, a.Name)
+	}
+	// .1 is kept because pics.1 survives; .4 is kept because it is newest.
+	if diff := cmp.Diff(got, []string{"_meta.2", "_meta.3"}); diff != "" {
+		t.Errorf("Wrong expired manifests: (-got, +want)\n%s", diff)
+	}
+}
+
+func TestPinned(t *testing.T) {
+	dir := t.TempDir()
+	pinFile := filepath.Join(dir, "pins.json")
+	ps := new(PinStore)
+	ps.Add("docs.20240301-0000", time.Now())
+	if err := ps.SaveTo(pinFile); err != nil {
+		t.Fatalf("Save pins: %v", err)
+	}
+
+	const input = `
+expiration:
+  - after: 1 day
+    sample: none
+pinned: [docs.20240101-0000]
+backup:
+  - name: docs
+    include: [stuff]
+`
+	cfg, err := Parse(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	cfg.PinFile = pinFile
+	if err := cfg.LoadPins(); err != nil {
+		t.Fatalf("LoadPins: %v", err)
+	}
+	var arch []tarsnap.Archive
+	for _, tag := range []string{".20240101-0000", ".20240201-0000", ".20240301-0000"} {
+		ts, _ := time.Parse(".20060102-1504", tag)
+		arch = append(arch, tarsnap.Archive{Name: "docs" + tag, Base: "docs", Tag: tag, Created: ts})
+	}
+	now := time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)
+
+	var got []string
+	for _, a := range cfg.FindExpired(arch, now) {
+		got = append(got, a.Name)
+	}
+	if diff := cmp.Diff(got, []string{"docs.20240201-0000"}); diff != "" {
+		t.Errorf("Wrong expired archives: (-got, +want)\n%s", diff)
+	}
+
+	if !ps.Remove("docs.20240301-0000") || ps.Remove("docs.20240301-0000") {
+		t.Error("Remove did not report the pin correctly")
+	}
+}
+
+func TestPruneLimits(t *testing.T) {
+	const input = `
+prune-limits:
+  min-retained: 2
+  max-delete-percent: 50
+backup:
+  - name: docs
+    include: [stuff]
+  - name: pics
+    include: [stuff]
+    prune-limits:
+      max-delete: 1
+      max-delete-percent: 100
+  - name: logs
+    include: [stuff]
+    prune-limits:
+      min-retained: 0
+      max-delete-percent: 0
+`
+	cfg, err := Parse(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	var arch []tarsnap.Archive
+	byName := make(map[string]tarsnap.Archive)
+	for _, base := range []string{"docs", "pics", "logs"} {
+		for i := 1; i <= 4; i++ {
+			a := tarsnap.Archive{
+				Name:    fmt.Sprintf("%s.%d", base, i),
+				Base:    base,
+				Created: time.Date(2024, 1, i, 0, 0, 0, 0, time.UTC),
+			}
+			arch = append(arch, a)
+			byName[a.Name] = a
+		}
+	}
+	tests := []struct {
+		expired []string
+		ok      bool
+	}{
+		{nil, true},
+		{[]string{"docs.1"}, true},
+		{[]string{"docs.1", "docs.2"}, true},
+		{[]string{"docs.1", "docs.2", "docs.3"}, false}, // min-retained, percent
+		{[]string{"docs.4"}, false},                     // newest
+		{[]string{"pics.1"}, true},
+		{[]string{"pics.1", "pics.2"}, false},          // max-delete
+		{[]string{"logs.1", "logs.2", "logs.3"}, true}, // zero overrides min-retained, percent
+	}
+	for _, test := range tests {
+		var expired []tarsnap.Archive
+		for _, name := range test.expired {
+			expired = append(expired, byName[name])
+		}
+		err := cfg.CheckPruneLimits(arch, expired)
+		if got := err == nil; got != test.ok {
+			t.Errorf("CheckPruneLimits(%q): got err=%v, want ok=%v", test.expired, err, test.ok)
+		}
+	}
+}
+
+func TestPruneClock(t *testing.T) {
+	cfg := &Config{
+		Backup:       []*Backup{{Name: "docs"}},
+		MaxClockSkew: 10 * Day,
+	}
+	newest := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	arch := []tarsnap.Archive{
+		{Name: "docs.1", Base: "docs", Created: newest.AddDate(0, 0, -7)},
+		{Name: "docs.2", Base: "docs", Created: newest},
+		{Name: "other.1", Base: "other", Created: newest.AddDate(1, 0, 0)}, // not a set
+	}
+	tests := []struct {
+		now time.Time
+		ok  bool
+	}{
+		{newest, true},
+		{newest.Add(-time.Hour), false}, // before the newest archive
+		{newest.AddDate(0, 0, 9), true},
+		{newest.AddDate(0, 0, 11), false}, // too far ahead
+	}
+	for _, test := range tests {
+		err := cfg.CheckPruneClock(arch, test.now)
+		if got := err == nil; got != test.ok {
+			t.Errorf("CheckPruneClock(%v): got err=%v, want ok=%v", test.now, err, test.ok)
+		}
+	}
+}
+
+func TestPruneAnchor(t *testing.T) {
+	const input = `
+prune-anchor: newest
+expiration:
+  - after: 5 days
+    sample: none
+backup:
+  - name: docs
+    include: [stuff]
+`
+	cfg, err := Parse(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	var arch []tarsnap.Archive
+	for _, tag := range []string{".20240101-0000", ".20240106-0000", ".20240110-0000"} {
+		ts, _ := time.Parse(".20060102-1504", tag)
+		arch = append(arch, tarsnap.Archive{Name: "docs" + tag, Base: "docs", Tag: tag, Created: ts})
+	}
+
+	// Months after the newest archive, only the archive more than 5 days older
+	// than the newest is expired.
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	var got []string
+	for _, a := range cfg.FindExpired(arch, now) {
+		got = append(got, a.Name)
+	}
+	if diff := cmp.Diff(got, []string{"docs.20240101-0000"}); diff != "" {
+		t.Errorf("Wrong expired archives: (-got, +want)\n%s", diff)
+	}
+
+	if _, err := Parse(strings.NewReader("prune-anchor: bogus\n")); err == nil {
+		t.Error("Parse: got nil, want error for invalid prune-anchor")
+	}
+}
+
+func TestPendingUpdate(t *testing.T) {
+	mk := func(name string) tarsnap.Archive {
+		base, _, _ := strings.Cut(name, ".")
+		return tarsnap.Archive{Name: name, Base: base}
+	}
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := &PendingStore{Pending: []*Pending{
+		{Archive: "docs.1", Base: "docs", Marked: t0},
+		{Archive: "docs.2", Base: "docs", Marked: t0},                  // no longer expired
+		{Archive: "docs.3", Base: "docs", Marked: t0.AddDate(0, 0, 5)}, // not yet due
+		{Archive: "pics.1", Base: "pics", Marked: t0},                  // not considered
+	}}
+	chosen := []tarsnap.Archive{mk("docs.1"), mk("docs.2"), mk("docs.3"), mk("docs.4")}
+	expired := []tarsnap.Archive{mk("docs.1"), mk("docs.3"), mk("docs.4")}
+
+	names := func(as []tarsnap.Archive) (out []string) {
+		for _, a := range as {
+			out = append(out, a.Name)
+		}
+		return
+	}
+	now := t0.AddDate(0, 0, 7)
+	due, marked := s.Update(chosen, expired, now, Week)
+	if diff := cmp.Diff(names(due), []string{"docs.1"}); diff != "" {
+		t.Errorf("Wrong due archives: (-got, +want)\n%s", diff)
+	}
+	if diff := cmp.Diff(names(marked), []string{"docs.4"}); diff != "" {
+		t.Errorf("Wrong marked archives: (-got, +want)\n%s", diff)
+	}
+	var left []string
+	for _, p := range s.Pending {
+		left = append(left, p.Archive)
+	}
+	if diff := cmp.Diff(left, []string{"docs.1", "docs.3", "pics.1", "docs.4"}); diff != "" {
+		t.Errorf("Wrong pending archives: (-got, +want)\n%s", diff)
+	}
+	if got := s.Remove("docs.1", "nonesuch"); !cmp.Equal(got, []string{"docs.1"}) {
+		t.Errorf("Remove: got %q, want [docs.1]", got)
+	}
+
+	// A cancelled archive is not marked again while it remains expired, but
+	// may be once it has stopped being expired.
+	if got := s.Cancel("docs.4", "nonesuch"); !cmp.Equal(got, []string{"docs.4"}) {
+		t.Errorf("Cancel: got %q, want [docs.4]", got)
+	}
+	if _, marked := s.Update(chosen, expired, now, Week); !cmp.Equal(names(marked), []string{"docs.1"}) {
+		t.Errorf("Update after Cancel: marked %q, want [docs.1]", names(marked))
+	}
+	s.Update(chosen, expired[:2], now, Week) // docs.4 is no longer expired
+	if len(s.Cancelled) != 0 {
+		t.Errorf("Cancelled: got %+v, want none", s.Cancelled)
+	}
+	if _, marked := s.Update(chosen, expired, now, Week); !cmp.Equal(names(marked), []string{"docs.4"}) {
+		t.Errorf("Update after expiring again: marked %q, want [docs.4]", names(marked))
+	}
+}
+
+func TestKeep(t *testing.T) {
+	const input = `
+expiration:
+  - keep-daily: 3
+    keep-weekly: 2
+backup:
+  - name: docs
+    include: [stuff]
+`
+	cfg, err := Parse(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	// One archive at noon each day, January 1-20, 2024.
+	var arch []tarsnap.Archive
+	for d := 1; d <= 20; d++ {
+		ts := time.Date(2024, 1, d, 12, 0, 0, 0, time.Local)
+		tag := ts.Format(".20060102-1504")
+		arch = append(arch, tarsnap.Archive{Name: "docs" + tag, Base: "docs", Tag: tag, Created: ts})
+	}
+	now := time.Date(2024, 1, 21, 0, 0, 0, 0, time.Local)
+	drop := mapset.New[string]()
+	for _, a := range cfg.FindExpired(arch, now) {
+		drop.Add(a.Name)
+	}
+	var kept []string
+	for _, a := range arch {
+		if !drop.Has(a.Name) {
+			kept = append(kept, a.Name)
+		}
+	}
+	// Daily keeps the 18th-20th; weekly keeps the 20th (week 3) and the 14th
+	// (the last day of week 2).
+	want := []string{"docs.20240114-1200", "docs.20240118-1200", "docs.20240119-1200", "docs.20240120-1200"}
+	if diff := cmp.Diff(kept, want); diff != "" {
+		t.Errorf("Wrong kept archives: (-got, +want)\n%s", diff)
+	}
+
+	const bad = `
+expiration:
+  - keep-daily: 3
+    latest: 1
+`
+	if _, err := Parse(strings.NewReader(bad)); err == nil {
+		t.Error("Parse: got nil, want error for keep with latest")
+	}
+}
+
+func TestCalendarSampling(t *testing.T) {
+	var arch []tarsnap.Archive
+	for _, tag := range []string{".20240115-1200", ".20240201-0300", ".20240210-1200", ".20240220-1200"} {
+		ts, _ := time.Parse(".20060102-1504", tag)
+		arch = append(arch, tarsnap.Archive{Name: "docs" + tag, Base: "docs", Tag: tag, Created: ts})
+	}
+	now := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		zone string
+		want []string
+	}{
+		// In New York, the archive at 03:00 UTC on February 1 was made in January.
+		{"America/New_York", []string{"docs.20240210-1200", "docs.20240115-1200"}},
+		{"UTC", []string{"docs.20240210-1200", "docs.20240201-0300"}},
+	}
+	for _, test := range tests {
+		input := fmt.Sprintf(`
+calendar-sampling: true
+time-zone: %s
+expiration:
+  - sample: 1/month
+backup:
+  - name: docs
+    include: [stuff]
+`, test.zone)
+		cfg, err := Parse(strings.NewReader(input))
+		if err != nil {
+			t.Fatalf("Parse failed: %v", err)
+		}
+		var got []string
+		for _, a := range cfg.FindExpired(arch, now) {
+			got = append(got, a.Name)
+		}
+		if diff := cmp.Diff(got, test.want); diff != "" {
+			t.Errorf("Zone %s: wrong expired archives: (-got, +want)\n%s", test.zone, diff)
+		}
+	}
+
+	if _, err := Parse(strings.NewReader("time-zone: Nowhere/Special\n")); err == nil {
+		t.Error("Parse: got nil, want error for invalid time-zone")
+	}
+}
+
+func TestBudget(t *testing.T) {
+	const input = `
+pinned: [docs.20240102-0000]
+expiration:
+  - budget: 10K
+backup:
+  - name: docs
+    include: [stuff]
+  - name: pics
+    include: [things]
+    expiration: "latest 3"
+`
+	cfg, err := Parse(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if !cfg.HasBudget() {
+		t.Error("HasBudget: got false, want true")
+	}
+	var arch []tarsnap.Archive
+	cfg.sizes = make(map[string]*tarsnap.Sizes)
+	for d := 1; d <= 5; d++ {
+		ts := time.Date(2024, 1, d, 0, 0, 0, 0, time.UTC)
+		tag := ts.Format(".20060102-1504")
+		a := tarsnap.Archive{Name: "docs" + tag, Base: "docs", Tag: tag, Created: ts}
+		arch = append(arch, a)
+		cfg.sizes[a.Name] = &tarsnap.Sizes{CompressedBytes: 6 << 10, CompressedUniqueBytes: 2 << 10}
+	}
+
+	// Only the archives of sets with a budget rule need sizes.
+	all := append(arch, tarsnap.Archive{Name: "pics.1", Base: "pics"}, tarsnap.Archive{Name: "other.1", Base: "other"})
+	if diff := cmp.Diff(cfg.BudgetArchives(all), arch); diff != "" {
+		t.Errorf("Wrong budget archives: (-got, +want)\n%s", diff)
+	}
+
+	// The estimate is 6K for the newest plus 2K for each of the other four, so
+	// two must go; the pinned archive is skipped.
+	var got []string
+	for _, a := range cfg.FindExpired(arch, time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)) {
+		got = append(got, a.Name)
+	}
+	if diff := cmp.Diff(got, []string{"docs.20240101-0000", "docs.20240103-0000"}); diff != "" {
+		t.Errorf("Wrong expired archives: (-got, +want)\n%s", diff)
+	}
+
+	for _, tc := range []struct {
+		in   string
+		want Bytes
+	}{
+		{"512", 512}, {"10K", 10 << 10}, {"1.5 GiB", 3 << 29}, {"2TB", 2 << 40}, {"20 gb", 20 << 30},
+	} {
+		got, err := parseBytes(tc.in)
+		if err != nil || got != tc.want {
+			t.Errorf("parseBytes(%q): got %v, %v; want %v", tc.in, got, err, tc.want)
+		}
+	}
+	if got := Bytes(3 << 29).String(); got != "1.5G" {
+		t.Errorf("String: got %q, want 1.5G", got)
+	}
+}
+
+func TestManifestNameReserved(t *testing.T) {
+	const input = `
+manifest: meta
+backup:
+  - name: meta
+    include: [stuff]
+`
+	if cfg, err := Parse(strings.NewReader(input)); err == nil {
+		t.Errorf("Parse: got %+v, want error", cfg)
+	}
+}
+
+func TestCompactRules(t *testing.T) {
+	tests := []struct {
+		input string
+		want  []*Policy
+		text  string
+	}{
+		{"", nil, ""},
+		{"latest 3", []*Policy{{Latest: 3, Max: forever}}, "latest 3"},
+		{"latest 3; 1d..2w 1/day; 2w..6mo 1/week; >6mo none", []*Policy{
+			{Min: Day, Max: 2 * Week, Sample: &Sampling{N: 1, Period: Day}},
+			{Min: 2 * Week, Max: 6 * Month, Sample: &Sampling{N: 1, Period: Week}},
+			{Min: 6 * Month, Max: forever, Sample: &Sampling{}},
+			{Latest: 3, Max: forever},
+		}, "1d..2w 1/day; 2w..6mo 1/week; >6mo none; latest 3"},
+		{" <36h latest 2 3/2d ; 1y.. all ;", []*Policy{
+			{Max: 36 * Hour, Latest: 2, Sample: &Sampling{N: 3, Period: 2 * Day}},
+			{Min: Year, Max: forever, Sample: &Sampling{N: 1}},
+		}, "<36h latest 2 3/2d; >1y all"},
+		{"keep-daily 7 keep-monthly 12", []*Policy{
+			{Max: forever, Keep: Keep{Daily: 7, Monthly: 12}},
+		}, "keep-daily 7 keep-monthly 12"},
+		{"budget 20G", []*Policy{{Max: forever, Budget: 20 << 30}}, "budget 20G"},
+	}
+	for _, test := range tests {
+		got, err := ParseRules(test.input)
+		if err != nil {
+			t.Errorf("ParseRules(%q) failed: %v", test.input, err)
+			continue
+		}
+		if diff := cmp.Diff(Rules(test.want), got); diff != "" {
+			t.Errorf("ParseRules(%q): (-want, +got)\n%s", test.input, diff)
+		}
+		if s := got.String(); s != test.text {
+			t.Errorf("Format %q: got %q, want %q", test.input, s, test.text)
+		}
+		if again, err := ParseRules(got.String()); err != nil {
+			t.Errorf("ParseRules(%q) failed: %v", got.String(), err)
+		} else if diff := cmp.Diff(got, again); diff != "" {
+			t.Errorf("Round trip of %q: (-want, +got)\n%s", test.input, diff)
+		}
+	}
+
+	for _, bad := range []string{
+		"..", "latest", "latest x", "1d..2q none", "none all", "3/fortnight",
+		"keep-daily 7 latest 2", ">1d budget 5G",
+	} {
+		if got, err := ParseRules(bad); err == nil {
+			t.Errorf("ParseRules(%q): got %v, want error", bad, got)
+		}
+	}
+
+	const input = `
+expiration: "latest 2; >1w none"
+policy:
+  short: "<3d all"
+backup:
+  - name: docs
+    include: [stuff]
+    policy: short
+    expiration:
+      - after: 3d
+        sample: 1/week
+`
+	cfg, err := Parse(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if got, want := cfg.Expiration.String(), ">1w none; latest 2"; got != want {
+		t.Errorf("Expiration: got %q, want %q", got, want)
+	}
+	if got, want := cfg.EffectiveRules(cfg.Backup[0]).String(), "<3d all; >3d 1/week"; got != want {
+		t.Errorf("EffectiveRules: got %q, want %q", got, want)
+	}
+}
@@ -53,6 +53,31 @@ const (
 	Year            = Interval(365.25 * float64(Day))
 )
 
+// units are the interval units in order of decreasing size, with their
+// abbreviations and names as rendered by String.
+var units = []struct {
+	iv         Interval
+	abbr, name string
+}{
+	{Year, "y", "year"},
+	{Month, "mo", "month"},
+	{Week, "w", "week"},
+	{Day, "d", "day"},
+	{Hour, "h", "hour"},
+	{Second, "s", "sec"},
+}
+
+// String renders iv in the largest unit that divides it evenly, for example
+// "2w" or "36h", in the format accepted by parseInterval.
+func (iv Interval) String() string {
+	for _, u := range units {
+		if iv != 0 && iv%u.iv == 0 {
+			return strconv.FormatInt(int64(iv/u.iv), 10) + u.abbr
+		}
+	}
+	return strconv.FormatInt(int64(iv), 10) + "s"
+}
+
 var dx = regexp.MustCompile(`^(\d+|\d*\.\d+)? ?(\w+)$`)
 
 func parseInterval(s string) (Interval, error) {
@@ -70,7 +95,7 @@ func parseInterval(s string) (Interval, error) {
 	switch m[2] {
 	case "s", "sec", "secs":
 		f *= float64(Second)
-	case "h", "hr", "hrs":
+	case "h", "hr", "hrs", "hour", "hours":
 		f *= float64(Hour)
 	case "d", "day", "days":
 		f *= float64(Day)
@@ -98,7 +123,12 @@ func (s *Sampling) String() string {
 	} else if s.Period == 0 {
 		return "all"
 	}
-	return fmt.Sprintf("%d/%d", s.N, s.Period)
+	for _, u := range units {
+		if s.Period == u.iv {
+			return fmt.Sprintf("%d/%s", s.N, u.name) // e.g., 1/day
+		}
+	}
+	return fmt.Sprintf("%d/%v", s.N, s.Period)
 }
 
 func (s *Sampling) parseFrom(raw string) error {
@@ -138,3 +168,54 @@ func (s *Sampling) UnmarshalYAML(unmarshal func(any) error) error {
 	}
 	return s.parseFrom(raw)
 }
+
+// Layouts for absolute time specifications, in order of preference.
+const (
+	localTimeLayout = "2006-01-02T15:04:05"
+	dateLayout      = "2006-01-02"
+)
+
+// parseAbsTime parses an absolute time in local time, RFC 3339, or date-only
+// format. A date-only value denotes midnight at the start of that day in the
+// local time zone, and is reported by dateOnly.
+func parseAbsTime(s string) (_ time.Time, dateOnly bool, _ error) {
+	if t, err := time.ParseInLocation(localTimeLayout, s, time.Local); err == nil {
+		return t, false, nil
+	} else if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, false, nil
+	} else if t, err := time.ParseInLocation(dateLayout, s, time.Local); err == nil {
+		return t, true, nil
+	}
+	return time.Time{}, false, fmt.Errorf("invalid time %q", s)
+}
+
+// ParseTime parses a time specification relative to now. The following
+// formats are accepted:
+//
+//	now                        -- the current time
+//	2006-01-02T15:04:05        -- a time of day in the local time zone
+//	2006-01-02T15:04:05-07:00  -- a time with a zone offset (RFC 3339)
+//	2006-01-02                 -- midnight at the start of a day, local time
+//	-INTERVAL                  -- INTERVAL before now, e.g., "-2w"
+//	INTERVAL ago               -- INTERVAL before now, e.g., "3 days ago"
+//
+// An INTERVAL has the format accepted by Interval.
+func ParseTime(s string, now time.Time) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if s == "now" {
+		return now, nil
+	}
+	rel, ok := strings.CutPrefix(s, "-")
+	if !ok {
+		rel, ok = strings.CutSuffix(s, " ago")
+	}
+	if ok {
+		iv, err := parseInterval(strings.TrimSpace(rel))
+		if err != nil {
+			return time.Time{}, err
+		}
+		return now.Add(-time.Duration(iv) * time.Second), nil
+	}
+	t, _, err := parseAbsTime(s)
+	return t, err
+}
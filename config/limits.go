@@ -0,0 +1,118 @@
+// Copyright (C) 2018 Michael J. Fromberger. All Rights Reserved.
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/creachadair/tarsnap"
+)
+
+// PruneLimits are safety limits on how many archives of a backup set may be
+// pruned at once. They guard against a mistaken clock or a broken policy
+// deleting too much. A zero value means no limit.
+type PruneLimits struct {
+	// Never leave fewer than this many archives in the set.
+	MinRetained int `json:"minRetained,omitempty" yaml:"min-retained"`
+
+	// Never delete more than this many archives of the set in one run.
+	MaxDelete int `json:"maxDelete,omitempty" yaml:"max-delete"`
+
+	// Never delete more than this percentage of the archives of the set in
+	// one run.
+	MaxDeletePercent float64 `json:"maxDeletePercent,omitempty" yaml:"max-delete-percent"`
+}
+
+// SetPruneLimits are prune limits for a single backup set. Each limit that is
+// set, including to zero (no limit), overrides the corresponding default.
+type SetPruneLimits struct {
+	MinRetained      *int     `json:"minRetained,omitempty" yaml:"min-retained"`
+	MaxDelete        *int     `json:"maxDelete,omitempty" yaml:"max-delete"`
+	MaxDeletePercent *float64 `json:"maxDeletePercent,omitempty" yaml:"max-delete-percent"`
+}
+
+// pruneLimits returns the prune limits in effect for b. Limits set for the
+// backup override the corresponding global limits.
+func (c *Config) pruneLimits(b *Backup) PruneLimits {
+	lim := c.PruneLimits
+	if b.PruneLimits == nil {
+		return lim
+	}
+	if v := b.PruneLimits.MinRetained; v != nil {
+		lim.MinRetained = *v
+	}
+	if v := b.PruneLimits.MaxDelete; v != nil {
+		lim.MaxDelete = *v
+	}
+	if v := b.PruneLimits.MaxDeletePercent; v != nil {
+		lim.MaxDeletePercent = *v
+	}
+	return lim
+}
+
+// CheckPruneClock reports an error if now is implausible as the current time
+// for pruning, given the archives in arch: that is, if now is earlier than the
+// creation of the newest archive of any backup set, or later than it by more
+// than the max-clock-skew setting.
+func (c *Config) CheckPruneClock(arch []tarsnap.Archive, now time.Time) error {
+	var newest tarsnap.Archive
+	for _, a := range arch {
+		if c.FindSet(a.Base) != nil && a.Created.After(newest.Created) {
+			newest = a
+		}
+	}
+	if newest.Name == "" {
+		return nil // nothing to compare with
+	} else if now.Before(newest.Created) {
+		return fmt.Errorf("current time %v is before the creation of the newest archive %q (%v)",
+			now.Format(time.RFC3339), newest.Name, newest.Created.Format(time.RFC3339))
+	} else if skew := now.Sub(newest.Created); c.MaxClockSkew > 0 && durationInterval(skew) > c.MaxClockSkew {
+		return fmt.Errorf("current time %v is %v after the newest archive %q, more than max-clock-skew %v",
+			now.Format(time.RFC3339), skew.Round(time.Minute), newest.Name, time.Duration(c.MaxClockSkew)*time.Second)
+	}
+	return nil
+}
+
+// CheckPruneLimits reports an error if deleting the expired archives from arch
+// would exceed the prune limits of any backup set. The newest archive of a
+// set may never be deleted. The error describes each limit exceeded.
+func (c *Config) CheckPruneLimits(arch, expired []tarsnap.Archive) error {
+	total := make(map[string]int)
+	newest := make(map[string]tarsnap.Archive)
+	for _, a := range arch {
+		total[a.Base]++
+		if n, ok := newest[a.Base]; !ok || a.Created.After(n.Created) {
+			newest[a.Base] = a
+		}
+	}
+	drop := make(map[string]int)
+	var errs []error
+	for _, a := range expired {
+		drop[a.Base]++
+		if a.Name == newest[a.Base].Name {
+			errs = append(errs, fmt.Errorf("%s: would delete the newest archive %q", a.Base, a.Name))
+		}
+	}
+	for _, b := range c.Backup {
+		n, del := total[b.Name], drop[b.Name]
+		if del == 0 {
+			continue
+		}
+		lim := c.pruneLimits(b)
+		if lim.MinRetained > 0 && n-del < lim.MinRetained {
+			errs = append(errs, fmt.Errorf("%s: would leave %d of %d archives, fewer than min-retained %d",
+				b.Name, n-del, n, lim.MinRetained))
+		}
+		if lim.MaxDelete > 0 && del > lim.MaxDelete {
+			errs = append(errs, fmt.Errorf("%s: would delete %d archives, more than max-delete %d",
+				b.Name, del, lim.MaxDelete))
+		}
+		if pct := 100 * float64(del) / float64(n); lim.MaxDeletePercent > 0 && pct > lim.MaxDeletePercent {
+			errs = append(errs, fmt.Errorf("%s: would delete %.1f%% of %d archives, more than max-delete-percent %g",
+				b.Name, pct, n, lim.MaxDeletePercent))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,102 @@
+// Copyright (C) 2018 Michael J. Fromberger. All Rights Reserved.
+
+package config
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/creachadair/mds/mapset"
+	"github.com/creachadair/tarsnap"
+)
+
+// Names of the files stored in a manifest archive.
+const (
+	ManifestFile       = "manifest.json" // the encoded Manifest
+	ManifestConfigFile = "snapback.yml"  // the original configuration file
+)
+
+// A Manifest records the settings in effect when a batch of archives was
+// created, so that the archives can be interpreted even if the configuration
+// has since changed or been lost.
+type Manifest struct {
+	Host    string         `json:"host"`
+	Version string         `json:"version"`
+	Created time.Time      `json:"created"`
+	Sets    []*ManifestSet `json:"sets"`
+	Config  *Config        `json:"config"`
+}
+
+// A ManifestSet records the settings used to create one archive.
+type ManifestSet struct {
+	Name    string `json:"name"`
+	Archive string `json:"archive"`
+
+	// The options used to create the archive, with include globs expanded and
+	// the working directory resolved.
+	tarsnap.CreateOptions
+}
+
+// Backup returns a backup with the settings recorded in m.
+func (m *ManifestSet) Backup() *Backup {
+	return &Backup{Name: m.Name, CreateOptions: m.CreateOptions}
+}
+
+// FindSet returns the set matching name, or nil if none matches.
+// A nil *Manifest contains no sets.
+func (m *Manifest) FindSet(name string) *ManifestSet {
+	if m == nil {
+		return nil
+	}
+	for _, s := range m.Sets {
+		if s.Name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// LoadManifest reads a manifest from the specified file.
+func LoadManifest(path string) (*Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// expiredManifests returns the manifest archives in arch that no longer
+// describe any retained archive, given that expired are to be removed. A
+// manifest describes the archives sharing its tag. The newest manifest is
+// always retained.
+func (c *Config) expiredManifests(arch, expired []tarsnap.Archive) []tarsnap.Archive {
+	drop := mapset.New[string]()
+	for _, a := range expired {
+		drop.Add(a.Name)
+	}
+	live := mapset.New[string]() // tags of retained archives
+	var manifests []tarsnap.Archive
+	for _, a := range arch {
+		if a.Base == c.Manifest {
+			manifests = append(manifests, a)
+		} else if !drop.Has(a.Name) {
+			live.Add(a.Tag)
+		}
+	}
+
+	var out []tarsnap.Archive
+	for i, m := range manifests {
+		if i == len(manifests)-1 || live.Has(m.Tag) {
+			c.logf("+ keep manifest %q", m.Name)
+			continue
+		}
+		c.logf("- drop manifest %q, no archives remain", m.Name)
+		out = append(out, m)
+	}
+	return out
+}
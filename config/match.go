@@ -69,10 +69,7 @@ func pathMatchesPattern(path, pat string) bool {
 
 func containsPath(b *Backup, wd, path string) (string, bool) {
 	// Normalize the path to be relative to where this backup was created.
-	base := b.WorkDir
-	if base == "" {
-		base = wd
-	}
+	base := b.Dir(wd)
 	needle := path
 	if !filepath.IsAbs(path) {
 		rel, err := filepath.Rel(base, filepath.Join(base, path))
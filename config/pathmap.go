@@ -0,0 +1,181 @@
+// Copyright (C) 2018 Michael J. Fromberger. All Rights Reserved.
+
+package config
+
+import (
+	"log"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/creachadair/tarsnap"
+)
+
+// ArchiveName returns the name of the entry that stores the file at path in
+// the archives of b. The path is either absolute or relative to the working
+// directory of b.
+//
+// Like tarsnap, ArchiveName first applies the substitution rules of b to the
+// path, and then removes any leading "/" unless b preserves paths.
+func (b *Backup) ArchiveName(path string) string {
+	path = b.modifyPath(path)
+	if !b.PreservePaths {
+		path = strings.TrimLeft(path, "/")
+	}
+	return path
+}
+
+// modifyPath returns path after applying the first matching substitution rule
+// of b, or path unchanged if no rule applies.
+func (b *Backup) modifyPath(path string) string {
+	for _, m := range b.Modify {
+		r, err := tarsnap.ParseRule(m)
+		if err != nil {
+			log.Printf("Warning: invalid substitution rule %#q: %v [ignored]", m, err)
+			continue
+		}
+		if s, ok := r.Apply(path); ok {
+			return s
+		}
+	}
+	return path
+}
+
+// LocalName returns the path of the file stored under name in the archives
+// of b, either absolute or relative to the working directory of b. It is the
+// inverse of ArchiveName.
+//
+// A substitution rule can be reversed only if its pattern and replacement are
+// both literal strings, and the replacement is not empty. If no local path
+// maps to name, or if name could have resulted from more than one local path
+// (for example, both from a path renamed by a rule and from the same path
+// unmodified), LocalName returns name unmodified and reports false.
+func (b *Backup) LocalName(name string) (string, bool) {
+	// If the leading "/" was removed from an absolute path, try to restore it.
+	// We can only tell by checking whether the path is under an absolute
+	// include path.
+	bases := []string{name}
+	if !b.PreservePaths && !filepath.IsAbs(name) && b.includesAbs("/"+name) {
+		bases = []string{"/" + name, name}
+	}
+	for _, base := range bases {
+		var cands []string
+		for _, m := range b.Modify {
+			if r, ok := parseInverse(m); ok {
+				if s, ok := r.apply(base); ok {
+					cands = append(cands, s)
+				}
+			}
+		}
+		var match []string
+		for _, cand := range append(cands, base) {
+			if b.ArchiveName(cand) == name && !slices.Contains(match, cand) {
+				match = append(match, cand)
+			}
+		}
+		if len(match) == 1 {
+			return match[0], true
+		} else if len(match) > 1 {
+			break // ambiguous
+		}
+	}
+	return name, false
+}
+
+// includesAbs reports whether path is at or beneath one of the absolute
+// include paths of b.
+func (b *Backup) includesAbs(path string) bool {
+	for _, in := range b.Include {
+		if !filepath.IsAbs(in) {
+			continue
+		} else if path == in || strings.HasPrefix(path, in+"/") {
+			return true
+		} else if b.GlobIncludes && pathMatchesPattern(path, in) {
+			return true
+		}
+	}
+	return false
+}
+
+// An inverseRule is the reversal of a literal substitution rule.
+type inverseRule struct {
+	old, new   string // replace new with old
+	start, end bool   // anchored at the start or end
+	global     bool   // replace all occurrences
+}
+
+func (r inverseRule) apply(s string) (string, bool) {
+	switch {
+	case r.start && r.end:
+		if s != r.new {
+			return s, false
+		}
+		return r.old, true
+	case r.start:
+		t, ok := strings.CutPrefix(s, r.new)
+		return r.old + t, ok
+	case r.end:
+		t, ok := strings.CutSuffix(s, r.new)
+		return t + r.old, ok
+	case !strings.Contains(s, r.new):
+		return s, false
+	case r.global:
+		return strings.ReplaceAll(s, r.new, r.old), true
+	default:
+		return strings.Replace(s, r.new, r.old, 1), true
+	}
+}
+
+// parseInverse parses a substitution rule of the form "/old/new/flags" and
+// reports whether it can be reversed. If so, it returns the inverse rule.
+func parseInverse(rule string) (inverseRule, bool) {
+	parts := strings.SplitN(rule, "/", 4)
+	if len(parts) != 4 || parts[0] != "" {
+		return inverseRule{}, false
+	}
+	var r inverseRule
+	pat := parts[1]
+	if t, ok := strings.CutPrefix(pat, "^"); ok {
+		r.start, pat = true, t
+	}
+	if t, ok := strings.CutSuffix(pat, "$"); ok && !strings.HasSuffix(t, `\`) {
+		r.end, pat = true, t
+	}
+	old, ok := literalPattern(pat)
+	if !ok {
+		return inverseRule{}, false
+	}
+	r.old = old
+
+	// The replacement must be non-empty and free of escapes and references to
+	// the matched text.
+	if parts[2] == "" || strings.ContainsAny(parts[2], `\~`) {
+		return inverseRule{}, false
+	}
+	r.new = parts[2]
+	r.global = strings.ContainsAny(parts[3], "gG")
+	return r, true
+}
+
+// literalPattern reports whether the POSIX basic regular expression pat
+// matches only a single literal string, and if so returns that string.
+func literalPattern(pat string) (string, bool) {
+	var lit strings.Builder
+	for i := 0; i < len(pat); i++ {
+		switch c := pat[i]; c {
+		case '\\':
+			// An escaped operator is literal; other escapes (groups, intervals,
+			// back-references) are not.
+			if i+1 == len(pat) || !strings.ContainsRune(`.[]*^$\`, rune(pat[i+1])) {
+				return "", false
+			}
+			i++
+			lit.WriteByte(pat[i])
+		case '.', '[', ']', '*', '^', '$':
+			return "", false
+		default:
+			lit.WriteByte(c)
+		}
+	}
+	return lit.String(), true
+}
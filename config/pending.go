@@ -0,0 +1,143 @@
+// Copyright (C) 2018 Michael J. Fromberger. All Rights Reserved.
+
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/creachadair/atomicfile"
+	"github.com/creachadair/mds/mapset"
+	"github.com/creachadair/tarsnap"
+)
+
+// A PendingStore is a ledger of archives marked for deletion by pruning, used
+// when pruning has a grace period. An archive is only deleted once it has been
+// pending for the grace period, and only if it is still expired then.
+type PendingStore struct {
+	Pending []*Pending `json:"pending"`
+
+	// Pending deletions that were cancelled. These archives are not marked
+	// again while they remain expired.
+	Cancelled []*Pending `json:"cancelled,omitempty"`
+}
+
+// A Pending records an archive marked for deletion.
+type Pending struct {
+	Archive string    `json:"archive"`
+	Base    string    `json:"base"`
+	Marked  time.Time `json:"marked"`
+}
+
+// LoadFrom populates s from the data stored in the specified file. A file
+// that does not exist contains no pending deletions.
+func (s *PendingStore) LoadFrom(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		s.Pending, s.Cancelled = nil, nil
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, s)
+}
+
+// SaveTo updates the specified file with the current pending deletions.
+func (s *PendingStore) SaveTo(path string) error {
+	bits, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("encoding pending deletions: %v", err)
+	} else if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("creating pending directory: %v", err)
+	} else if err := atomicfile.WriteData(path, bits, 0600); err != nil {
+		return fmt.Errorf("writing pending file: %v", err)
+	}
+	return nil
+}
+
+// Find returns the pending deletion of the named archive, or nil.
+func (s *PendingStore) Find(name string) *Pending {
+	for _, p := range s.Pending {
+		if p.Archive == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// Remove discards the pending deletions and cancellations of the named
+// archives, for example because they have been deleted, and returns the names
+// that were pending.
+func (s *PendingStore) Remove(names ...string) []string {
+	out, _ := s.remove(names...)
+	return out
+}
+
+func (s *PendingStore) remove(names ...string) ([]string, []*Pending) {
+	want := mapset.New(names...)
+	var out []string
+	var ps []*Pending
+	s.Pending = slices.DeleteFunc(s.Pending, func(p *Pending) bool {
+		if want.Has(p.Archive) {
+			out = append(out, p.Archive)
+			ps = append(ps, p)
+			return true
+		}
+		return false
+	})
+	s.Cancelled = slices.DeleteFunc(s.Cancelled, func(p *Pending) bool { return want.Has(p.Archive) })
+	return out, ps
+}
+
+// Cancel cancels the pending deletions of the named archives, and returns the
+// names that were pending. A cancelled archive is not marked for deletion
+// again by Update until it is no longer expired.
+func (s *PendingStore) Cancel(names ...string) []string {
+	out, ps := s.remove(names...)
+	s.Cancelled = append(s.Cancelled, ps...)
+	return out
+}
+
+// Update records the archives of expired that are newly marked for deletion,
+// as of now, and returns those whose grace period has elapsed, which may now
+// be deleted. The chosen archives are those considered for pruning: Pending
+// deletions of archives in the backup sets of chosen that are no longer
+// expired (or no longer exist) are cancelled, and cancellations of such
+// archives are forgotten. Cancelled archives are not marked. It also returns
+// the archives newly marked.
+func (s *PendingStore) Update(chosen, expired []tarsnap.Archive, now time.Time, grace Interval) (due, marked []tarsnap.Archive) {
+	sets := mapset.New[string]()
+	for _, a := range chosen {
+		sets.Add(a.Base)
+	}
+	exp := mapset.New[string]()
+	for _, a := range expired {
+		exp.Add(a.Name)
+	}
+	stale := func(p *Pending) bool { return sets.Has(p.Base) && !exp.Has(p.Archive) }
+	s.Pending = slices.DeleteFunc(s.Pending, stale)
+	s.Cancelled = slices.DeleteFunc(s.Cancelled, stale)
+	cancelled := mapset.New[string]()
+	for _, p := range s.Cancelled {
+		cancelled.Add(p.Archive)
+	}
+
+	for _, a := range expired {
+		p := s.Find(a.Name)
+		if cancelled.Has(a.Name) {
+			continue
+		} else if p == nil {
+			s.Pending = append(s.Pending, &Pending{Archive: a.Name, Base: a.Base, Marked: now})
+			marked = append(marked, a)
+		} else if durationInterval(now.Sub(p.Marked)) >= grace {
+			due = append(due, a)
+		}
+	}
+	return due, marked
+}
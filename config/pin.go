@@ -0,0 +1,108 @@
+// Copyright (C) 2018 Michael J. Fromberger. All Rights Reserved.
+
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/creachadair/atomicfile"
+	"github.com/creachadair/tarsnap"
+)
+
+// A PinStore records archives pinned from the command line, which must never
+// be pruned. It is stored locally, alongside the configuration.
+type PinStore struct {
+	Pins []*Pin `json:"pins"`
+}
+
+// A Pin records the pinning of a single archive.
+type Pin struct {
+	Archive string    `json:"archive"`
+	Pinned  time.Time `json:"pinned"`
+}
+
+// LoadFrom populates s from the data stored in the specified file. A file
+// that does not exist contains no pins.
+func (s *PinStore) LoadFrom(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		s.Pins = nil
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, s)
+}
+
+// SaveTo updates the specified file with the current pins.
+func (s *PinStore) SaveTo(path string) error {
+	bits, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("encoding pins: %v", err)
+	} else if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("creating pin directory: %v", err)
+	} else if err := atomicfile.WriteData(path, bits, 0600); err != nil {
+		return fmt.Errorf("writing pin file: %v", err)
+	}
+	return nil
+}
+
+// Add pins the named archive as of now, and reports whether it was not
+// already pinned.
+func (s *PinStore) Add(name string, now time.Time) bool {
+	if s.Has(name) {
+		return false
+	}
+	s.Pins = append(s.Pins, &Pin{Archive: name, Pinned: now})
+	return true
+}
+
+// Remove unpins the named archive, and reports whether it was pinned.
+func (s *PinStore) Remove(name string) bool {
+	n := len(s.Pins)
+	s.Pins = slices.DeleteFunc(s.Pins, func(p *Pin) bool { return p.Archive == name })
+	return len(s.Pins) != n
+}
+
+// Has reports whether the named archive is pinned in s.
+func (s *PinStore) Has(name string) bool {
+	return slices.ContainsFunc(s.Pins, func(p *Pin) bool { return p.Archive == name })
+}
+
+// LoadPins reads the pin file of c, if one is set, so that the archives it
+// pins are honored by FindExpired. Archives named in the configuration are
+// always honored, whether or not LoadPins is called.
+func (c *Config) LoadPins() error {
+	c.pins = new(PinStore)
+	if c.PinFile == "" {
+		return nil
+	}
+	if err := c.pins.LoadFrom(c.PinFile); err != nil {
+		return fmt.Errorf("loading pins: %w", err)
+	}
+	return nil
+}
+
+// IsPinned reports whether the named archive is pinned, either by the
+// configuration or by the pin file (if loaded).
+func (c *Config) IsPinned(name string) bool {
+	return slices.Contains(c.Pinned, name) || (c.pins != nil && c.pins.Has(name))
+}
+
+// keepPinned returns the archives of arch that are not pinned.
+func (c *Config) keepPinned(arch []tarsnap.Archive) []tarsnap.Archive {
+	return slices.DeleteFunc(arch, func(a tarsnap.Archive) bool {
+		if c.IsPinned(a.Name) {
+			c.logf("+ keep %q [kept: pinned]", a.Name)
+			return true
+		}
+		return false
+	})
+}
@@ -5,6 +5,8 @@ package config
 import (
 	"fmt"
 	"sort"
+	"strings"
+	"time"
 
 	"github.com/creachadair/tarsnap"
 )
@@ -40,10 +42,132 @@ type Policy struct {
 	// over time, and the latest-created archive in each window is selected as
 	// the candidate for that window.
 	Sample *Sampling
+
+	// If any counts are set, keep archives by count per calendar period
+	// instead of by Latest and Sample.
+	Keep `yaml:",inline"`
+
+	// If positive, this is a budget rule: After the other rules are applied,
+	// the oldest archives of the set are expired until its estimated storage
+	// is within this size (see LoadSizes). A budget rule has no other fields.
+	Budget Bytes `json:"budget,omitempty"`
+}
+
+// Keep is a count-based retention rule, in the style of other backup tools.
+// Beginning with the newest archive, it keeps the newest archive in each of
+// the specified number of most recent hours, days, weeks, months, and years
+// that contain an archive, as well as the specified number of most recent
+// archives. An archive kept for any reason is retained. Periods are based on
+// the calendar in the configured time zone (see Config.TimeZone), and weeks
+// are ISO 8601 weeks.
+type Keep struct {
+	Last    int `json:"keepLast,omitempty" yaml:"keep-last"`
+	Hourly  int `json:"keepHourly,omitempty" yaml:"keep-hourly"`
+	Daily   int `json:"keepDaily,omitempty" yaml:"keep-daily"`
+	Weekly  int `json:"keepWeekly,omitempty" yaml:"keep-weekly"`
+	Monthly int `json:"keepMonthly,omitempty" yaml:"keep-monthly"`
+	Yearly  int `json:"keepYearly,omitempty" yaml:"keep-yearly"`
+}
+
+// IsSet reports whether any of the counts of k are set.
+func (k Keep) IsSet() bool { return k != Keep{} }
+
+// String renders k in the syntax of the configuration file.
+func (k Keep) String() string {
+	var parts []string
+	for _, f := range k.fields() {
+		if f.n > 0 {
+			parts = append(parts, fmt.Sprintf("keep-%s %d", f.name, f.n))
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// A keepField is a count of k with a function mapping a time to the period
+// it belongs to. Last is keyed by the time itself.
+type keepField struct {
+	name string
+	n    int
+	key  func(time.Time) string
+}
+
+func (k Keep) fields() []keepField {
+	return []keepField{
+		{"last", k.Last, func(t time.Time) string { return t.Format(time.RFC3339Nano) }},
+		{"hourly", k.Hourly, hourKey},
+		{"daily", k.Daily, dayKey},
+		{"weekly", k.Weekly, weekKey},
+		{"monthly", k.Monthly, monthKey},
+		{"yearly", k.Yearly, yearKey},
+	}
+}
+
+// Keys for calendar periods, mapping a time to the period containing it.
+func hourKey(t time.Time) string  { return t.Format("2006-01-02T15") }
+func dayKey(t time.Time) string   { return t.Format(time.DateOnly) }
+func monthKey(t time.Time) string { return t.Format("2006-01") }
+func yearKey(t time.Time) string  { return t.Format("2006") }
+
+func weekKey(t time.Time) string {
+	y, w := t.ISOWeek()
+	return fmt.Sprintf("%04d-W%02d", y, w)
+}
+
+// calendarKey returns the key function for calendar-aligned sampling by s, or
+// nil if calendar sampling is not enabled or s does not sample once per hour,
+// day, week, month, or year.
+func (c *Config) calendarKey(s *Sampling) func(time.Time) string {
+	if !c.CalendarSampling || s.N != 1 {
+		return nil
+	}
+	switch s.Period {
+	case Hour:
+		return hourKey
+	case Day:
+		return dayKey
+	case Week:
+		return weekKey
+	case Month:
+		return monthKey
+	case Year:
+		return yearKey
+	}
+	return nil
+}
+
+// apply returns all the input archives that are not kept by k. The batch is
+// ordered by creation time, oldest to newest.
+func (k Keep) apply(c *Config, batch []tarsnap.Archive) []tarsnap.Archive {
+	fields := k.fields()
+	last := make([]string, len(fields)) // the most recent period kept for each
+	var drop []tarsnap.Archive
+	for i := len(batch) - 1; i >= 0; i-- {
+		t := batch[i].Created.In(c.location())
+		var why []string
+		for j, f := range fields {
+			if f.n == 0 {
+				continue
+			} else if key := f.key(t); key != last[j] {
+				last[j] = key
+				fields[j].n--
+				why = append(why, f.name)
+			}
+		}
+		if len(why) == 0 {
+			drop = append(drop, batch[i])
+			c.logf("- drop %q by %v", batch[i].Name, k)
+		} else {
+			c.logf("+ keep %q by %v [%s]", batch[i].Name, k, strings.Join(why, ", "))
+		}
+	}
+	return drop
 }
 
 // apply returns all the input archives that are expired by p.
 func (p *Policy) apply(c *Config, batch []tarsnap.Archive) []tarsnap.Archive {
+	if p.Keep.IsSet() {
+		return p.Keep.apply(c, batch)
+	}
 	if p.Latest >= len(batch) {
 		c.logf("+ keep %d, all candidates are recent", len(batch))
 		return nil
@@ -59,6 +183,10 @@ func (p *Policy) apply(c *Config, batch []tarsnap.Archive) []tarsnap.Archive {
 		return nil
 	}
 
+	if key := c.calendarKey(p.Sample); key != nil {
+		return p.applyCalendar(c, batch, key)
+	}
+
 	// The width of the scaled sampling interval, where s/p = 1/ival.
 	ival := p.Sample.Period / Interval(p.Sample.N)
 
@@ -86,13 +214,22 @@ func (p *Policy) apply(c *Config, batch []tarsnap.Archive) []tarsnap.Archive {
 	return drop
 }
 
-// String renders the policy in human-readable form.
-func (p *Policy) String() string {
-	max := "∞"
-	if p.Max != forever {
-		max = fmt.Sprint(max)
+// applyCalendar returns the archives of batch expired by p, keeping the latest
+// archive in each calendar period as defined by key.
+func (p *Policy) applyCalendar(c *Config, batch []tarsnap.Archive, key func(time.Time) string) []tarsnap.Archive {
+	var drop []tarsnap.Archive
+	var last string
+	for i := len(batch) - 1; i >= 0; i-- {
+		k := key(batch[i].Created.In(c.location()))
+		if k == last {
+			drop = append(drop, batch[i])
+			c.logf("- drop %q by calendar sampling rule %v [%s]", batch[i].Name, p.Sample, k)
+		} else {
+			last = k
+			c.logf("+ keep %q by calendar sampling rule %v [%s]", batch[i].Name, p.Sample, k)
+		}
 	}
-	return fmt.Sprintf("rule [%v..%s] keep %d sample %s", p.Min, max, p.Latest, p.Sample)
+	return drop
 }
 
 // Less reports whether p precedes q in canonical order. Policies are ordered
@@ -107,6 +244,18 @@ func (p *Policy) Less(q *Policy) bool {
 
 const forever = 1<<63 - 1
 
+// checkExp reports an error if any of the rules in es is invalid.
+func checkExp(es []*Policy) error {
+	for _, e := range es {
+		if e.Keep.IsSet() && (e.Latest != 0 || e.Sample != nil) {
+			return fmt.Errorf("rule %v: keep counts cannot be combined with latest or sample", e)
+		} else if e.Budget > 0 && (e.Keep.IsSet() || e.Latest != 0 || e.Sample != nil || e.Min != 0 || e.Max != forever) {
+			return fmt.Errorf("budget %v cannot be combined with other rule settings", e.Budget)
+		}
+	}
+	return nil
+}
+
 func sortExp(es []*Policy) {
 	// Treat max == 0 as having no effective upper bound.
 	for _, e := range es {
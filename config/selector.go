@@ -0,0 +1,121 @@
+// Copyright (C) 2018 Michael J. Fromberger. All Rights Reserved.
+
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/creachadair/tarsnap"
+)
+
+// A Selector identifies an archive of a backup set, either by its exact name
+// or by its position in the archive listing. A selector can be parsed from a
+// string in one of the following formats:
+//
+//	set@latest     -- the most recent archive of set
+//	set~N          -- the Nth most recent archive of set (set~1 is the latest)
+//	set@DATE       -- the latest archive of set created no later than DATE
+//	set@-INTERVAL  -- the latest archive of set as of INTERVAL before present
+//	name           -- the archive with exactly this name
+//
+// A DATE has the form "2006-01-02T15:04:05" or "2006-01-02" in local time, or
+// is an RFC 3339 timestamp with a zone offset; a date without a time of day
+// includes the whole day. An INTERVAL has the format accepted by Interval, for
+// example "3d" or "2 weeks".
+//
+// The set name may be omitted from a relative selector (e.g., "@latest" or
+// "~2"), in which case the caller must supply a set before resolving it.
+type Selector struct {
+	Set  string // the name of the backup set
+	Name string // if non-empty, the exact archive name
+
+	Index int       // if positive, select the Index-th most recent archive
+	AsOf  time.Time // if non-zero, select the latest archive as of this time
+	Ago   Interval  // if positive, select the latest archive as of this long ago
+}
+
+// IsSelector reports whether s has the syntax of a relative archive selector,
+// rather than an exact archive name.
+func IsSelector(s string) bool { return strings.ContainsAny(s, "@~") }
+
+// ParseSelector parses a selector from s.
+func ParseSelector(s string) (*Selector, error) {
+	if i := strings.LastIndex(s, "~"); i >= 0 {
+		n, err := strconv.Atoi(s[i+1:])
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid archive index %q", s[i+1:])
+		}
+		return &Selector{Set: s[:i], Index: n}, nil
+	}
+	set, spec, ok := strings.Cut(s, "@")
+	if !ok {
+		return &Selector{Name: s}, nil
+	}
+	if spec == "latest" {
+		return &Selector{Set: set, Index: 1}, nil
+	} else if t, ok := strings.CutPrefix(spec, "-"); ok {
+		iv, err := parseInterval(t)
+		if err != nil {
+			return nil, err
+		}
+		return &Selector{Set: set, Ago: iv}, nil
+	}
+	t, dateOnly, err := parseAbsTime(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid archive selector %q", s)
+	} else if dateOnly {
+		t = t.AddDate(0, 0, 1).Add(-time.Second) // include the whole day
+	}
+	return &Selector{Set: set, AsOf: t}, nil
+}
+
+// Resolve returns the archive from as denoted by s, given that now is the
+// moment denoting the present. The archives must be ordered as by List.
+func (s *Selector) Resolve(as tarsnap.Archives, now time.Time) (tarsnap.Archive, error) {
+	if s.Name != "" {
+		for _, a := range as {
+			if a.Name == s.Name {
+				return a, nil
+			}
+		}
+		return tarsnap.Archive{}, fmt.Errorf("archive %q not found", s.Name)
+	} else if s.Set == "" {
+		return tarsnap.Archive{}, fmt.Errorf("selector %v does not specify a backup set", s)
+	}
+
+	when := now
+	if !s.AsOf.IsZero() {
+		when = s.AsOf
+	} else if s.Ago > 0 {
+		when = now.Add(-time.Duration(s.Ago) * time.Second)
+	}
+	n := max(s.Index, 1)
+	for i := len(as) - 1; i >= 0; i-- {
+		if as[i].Base != s.Set || as[i].Created.After(when) {
+			continue
+		}
+		if n--; n == 0 {
+			return as[i], nil
+		}
+	}
+	return tarsnap.Archive{}, fmt.Errorf("no archive matches %v", s)
+}
+
+// String renders the selector in the syntax accepted by ParseSelector.
+func (s *Selector) String() string {
+	switch {
+	case s.Name != "":
+		return s.Name
+	case !s.AsOf.IsZero():
+		return s.Set + "@" + s.AsOf.In(time.Local).Format(localTimeLayout)
+	case s.Ago > 0:
+		return fmt.Sprintf("%s@-%ds", s.Set, s.Ago)
+	case s.Index > 1:
+		return fmt.Sprintf("%s~%d", s.Set, s.Index)
+	default:
+		return s.Set + "@latest"
+	}
+}
@@ -0,0 +1,338 @@
+// Copyright (C) 2018 Michael J. Fromberger. All Rights Reserved.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/creachadair/mds/mapset"
+	"github.com/creachadair/snapback/config"
+	"github.com/creachadair/tarsnap"
+)
+
+// A drillRecord is the result of a restore drill for one backup set, as saved
+// in the drill history file.
+type drillRecord struct {
+	Time     time.Time     `json:"time"`
+	Set      string        `json:"set"`
+	Archive  string        `json:"archive"`
+	Checked  int           `json:"checked"`
+	Content  int           `json:"content"` // how many were compared with live files
+	Failures []discrepancy `json:"failures,omitempty"`
+}
+
+// Passed reports whether the drill found no problems.
+func (r drillRecord) Passed() bool { return len(r.Failures) == 0 }
+
+// restoreDrill restores a random sample of n files from the latest archive of
+// each selected backup set into a temporary directory, and checks them. A file
+// that has not changed locally since the archive was created is compared with
+// the live copy; otherwise it is checked against the archive metadata. The
+// results are appended to the drill history file, if one is configured. It
+// reports an error if the drill could not be run or any check failed.
+//
+// The restored files are removed before restoreDrill returns, so that copies
+// of backed-up files are not left behind in the temporary directory.
+func restoreDrill(cfg *config.Config, as tarsnap.Archives, n int) error {
+	now := effectiveNow()
+	var sets []*config.Backup
+	if flag.NArg() == 0 {
+		sets = cfg.Backup
+	} else {
+		for _, name := range flag.Args() {
+			b := cfg.FindSet(name)
+			if b == nil {
+				log.Fatalf("No such backup set %q", name)
+			}
+			sets = append(sets, b)
+		}
+	}
+	if cfg.DrillHistory == "" {
+		log.Print("[WARNING] No drill-history file is configured; results will not be saved")
+	}
+
+	tmp, err := os.MkdirTemp("", "snapback-drill-")
+	if err != nil {
+		log.Fatalf("Creating temporary directory: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var recs []drillRecord
+	var failed bool
+	for _, b := range sets {
+		arch, ok := as.LatestAsOf(b.Name, now)
+		if !ok {
+			log.Printf("[WARNING] No %q archive found; skipping", b.Name)
+			continue
+		}
+		rec, err := drillSet(cfg, b, arch, n, filepath.Join(tmp, b.Name))
+		if err != nil {
+			return err
+		}
+		rec.Time = now
+		if err := appendDrillHistory(cfg.DrillHistory, rec); err != nil {
+			log.Printf("[WARNING] Saving drill history: %v", err)
+		}
+		failed = failed || !rec.Passed()
+		recs = append(recs, rec)
+	}
+
+	if *doJSON {
+		bits, _ := json.Marshal(struct {
+			N time.Time     `json:"now"`
+			R []drillRecord `json:"drills"`
+		}{N: now.In(time.UTC), R: recs})
+		fmt.Println(string(bits))
+	} else {
+		tw := tabwriter.NewWriter(os.Stdout, 0, 8, 3, ' ', 0)
+		for _, r := range recs {
+			result := "PASS"
+			if !r.Passed() {
+				result = "FAIL"
+			}
+			fmt.Fprint(tw, result, "\t", r.Archive, "\t",
+				r.Checked, " files\t", r.Content, " compared\n")
+		}
+		tw.Flush()
+	}
+	for _, r := range recs {
+		for _, d := range r.Failures {
+			fmt.Fprintln(os.Stderr, "FAILED", d)
+		}
+	}
+	if failed {
+		return errors.New("restore drill failed")
+	}
+	return nil
+}
+
+// drillSet runs a restore drill of up to n files from arch, a member of the
+// backup set b, extracting them into dir. It reports an error only if the
+// archive could not be listed; other problems are recorded as failures.
+func drillSet(cfg *config.Config, b *config.Backup, arch tarsnap.Archive, n int, dir string) (drillRecord, error) {
+	rec := drillRecord{Set: b.Name, Archive: arch.Name}
+
+	// Choose a uniform sample of the regular files in the archive. Names that
+	// tarsnap would interpret as patterns are skipped.
+	fmt.Fprintf(os.Stderr, "-- Sampling %d files from %q\n", n, arch.Name)
+	var sample []*tarsnap.Entry
+	seen := 0
+	if err := cfg.Entries(arch.Name, func(e *tarsnap.Entry) error {
+		if !e.Mode.IsRegular() || isGlob(e.Name) {
+			return nil
+		}
+		seen++
+		if len(sample) < n {
+			sample = append(sample, e)
+		} else if i := rand.IntN(seen); i < n {
+			sample[i] = e
+		}
+		return nil
+	}); err != nil {
+		return rec, fmt.Errorf("listing entries for %q: %w", arch.Name, err)
+	}
+	if len(sample) == 0 {
+		log.Printf("[WARNING] No files to check in %q", arch.Name)
+		return rec, nil
+	}
+
+	names := make([]string, len(sample))
+	for i, e := range sample {
+		names[i] = e.Name
+	}
+	fmt.Fprintf(os.Stderr, "-- Restoring %d files from %q\n", len(names), arch.Name)
+	if err := cfg.Config.Extract(arch.Name, tarsnap.ExtractOptions{
+		Include:            names,
+		WorkDir:            dir,
+		RestorePermissions: true,
+	}); err != nil {
+		// Report the failure for every file, rather than giving up, so that it
+		// is recorded in the history.
+		for _, e := range sample {
+			rec.Failures = append(rec.Failures, discrepancy{
+				Entry: e.Name, Path: dir, Problem: "extract failed: " + err.Error(),
+			})
+		}
+		rec.Checked = len(sample)
+		return rec, nil
+	}
+
+	base := b.Dir(cfg.WorkDir)
+	for _, e := range sample {
+		rec.Checked++
+		path := filepath.Join(dir, strings.TrimLeft(e.Name, "/"))
+		if d, ok := verifyFile(e, path); !ok {
+			rec.Failures = append(rec.Failures, d)
+			continue
+		}
+		local, ok := b.LocalName(e.Name)
+		if !ok {
+			continue // no way to tell which live file to compare with
+		}
+		if !filepath.IsAbs(local) {
+			local = filepath.Join(base, local)
+		}
+		if !unchangedSince(local, e) {
+			continue
+		}
+		rec.Content++
+		if same, err := sameContents(path, local); err != nil {
+			rec.Failures = append(rec.Failures, discrepancy{Entry: e.Name, Path: local, Problem: err.Error()})
+		} else if !same {
+			rec.Failures = append(rec.Failures, discrepancy{
+				Entry: e.Name, Path: local, Problem: "restored contents differ from the live file",
+			})
+		}
+	}
+	return rec, nil
+}
+
+// unchangedSince reports whether the file at path has the size and
+// modification time recorded in e, suggesting it has not changed since it was
+// archived.
+func unchangedSince(path string, e *tarsnap.Entry) bool {
+	fi, err := os.Lstat(path)
+	return err == nil && fi.Mode().IsRegular() && fi.Size() == e.Size &&
+		fi.ModTime().Truncate(time.Second).Equal(e.ModTime)
+}
+
+// sameContents reports whether the files at a and b have the same contents.
+func sameContents(a, b string) (bool, error) {
+	da, err := os.ReadFile(a)
+	if err != nil {
+		return false, err
+	}
+	db, err := os.ReadFile(b)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(da, db), nil
+}
+
+// appendDrillHistory adds rec to the drill history file at path. If path is
+// empty, the record is discarded.
+func appendDrillHistory(path string, rec drillRecord) error {
+	if path == "" {
+		return nil
+	} else if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	bits, _ := json.Marshal(rec)
+	_, err = fmt.Fprintln(f, string(bits))
+	return errors.Join(err, f.Close())
+}
+
+// loadDrillHistory reads the drill records from the history file at path, in
+// the order they were recorded. A missing file has no records.
+func loadDrillHistory(path string) ([]drillRecord, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var out []drillRecord
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, 1<<20)
+	for s.Scan() {
+		var rec drillRecord
+		if err := json.Unmarshal(s.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("invalid drill record: %w", err)
+		}
+		out = append(out, rec)
+	}
+	return out, s.Err()
+}
+
+// drillStatus reports the most recent restore drill of each backup set, and
+// when each set last passed a drill.
+func drillStatus(cfg *config.Config) {
+	if cfg.DrillHistory == "" {
+		log.Fatal("No drill-history file is configured")
+	}
+	recs, err := loadDrillHistory(cfg.DrillHistory)
+	if err != nil {
+		log.Fatalf("Loading drill history: %v", err)
+	}
+	want := mapset.New(flag.Args()...)
+	var sets []string
+	for _, b := range cfg.Backup {
+		if want.IsEmpty() || want.Has(b.Name) {
+			sets = append(sets, b.Name)
+		}
+	}
+	out := summarizeDrills(sets, recs)
+
+	if *doJSON {
+		bits, _ := json.Marshal(out)
+		fmt.Println(string(bits))
+		return
+	}
+	const never = "never"
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 3, ' ', 0)
+	fmt.Fprintln(tw, "SET\tLAST DRILL\tRESULT\tLAST PASSED\tDRILLS")
+	for _, st := range out {
+		last, result, passed := never, "-", never
+		if st.Last != nil {
+			last = st.Last.Time.In(time.Local).Format(time.RFC3339)
+			result = "PASS"
+			if !st.Last.Passed() {
+				result = fmt.Sprintf("FAIL (%d of %d)", len(st.Last.Failures), st.Last.Checked)
+			}
+		}
+		if !st.LastPassed.IsZero() {
+			passed = st.LastPassed.In(time.Local).Format(time.RFC3339)
+		}
+		fmt.Fprint(tw, st.Set, "\t", last, "\t", result, "\t", passed, "\t", st.Drills, "\n")
+	}
+	tw.Flush()
+}
+
+// A drillSummary is the drill status of one backup set, reported by -status.
+type drillSummary struct {
+	Set        string       `json:"set"`
+	Last       *drillRecord `json:"last,omitempty"`
+	LastPassed time.Time    `json:"lastPassed,omitzero"`
+	Drills     int          `json:"drills"`
+}
+
+// summarizeDrills combines the drill records in recs, which are in the order
+// they were recorded, into a summary for each of the named sets. A set with no
+// records has an empty summary.
+func summarizeDrills(sets []string, recs []drillRecord) []*drillSummary {
+	var out []*drillSummary
+	for _, set := range sets {
+		st := &drillSummary{Set: set}
+		for _, r := range recs {
+			if r.Set != set {
+				continue
+			}
+			st.Drills++
+			st.Last = &r
+			if r.Passed() {
+				st.LastPassed = r.Time
+			}
+		}
+		out = append(out, st)
+	}
+	return out
+}
@@ -0,0 +1,115 @@
+// Copyright (C) 2018 Michael J. Fromberger. All Rights Reserved.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/creachadair/tarsnap"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestUnchangedSince(t *testing.T) {
+	dir := t.TempDir()
+	mtime := time.Date(2024, 4, 1, 9, 0, 0, 0, time.UTC)
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, []byte("hello"), 0600); err != nil {
+		t.Fatal(err)
+	} else if err := os.Chtimes(file, mtime, mtime.Add(250*time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink("file", link); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		path string
+		e    tarsnap.Entry
+		want bool
+	}{
+		{"same", file, tarsnap.Entry{Size: 5, ModTime: mtime}, true},
+		{"size", file, tarsnap.Entry{Size: 4, ModTime: mtime}, false},
+		{"mtime", file, tarsnap.Entry{Size: 5, ModTime: mtime.Add(-time.Second)}, false},
+		{"missing", filepath.Join(dir, "nonesuch"), tarsnap.Entry{Size: 5, ModTime: mtime}, false},
+		{"symlink", link, tarsnap.Entry{Size: 5, ModTime: mtime}, false},
+		{"dir", dir, tarsnap.Entry{Size: 5, ModTime: mtime}, false},
+	}
+	for _, test := range tests {
+		if got := unchangedSince(test.path, &test.e); got != test.want {
+			t.Errorf("unchangedSince %s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestDrillHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sub", "history.jsonl")
+
+	// A missing history file has no records.
+	if recs, err := loadDrillHistory(path); err != nil || len(recs) != 0 {
+		t.Fatalf("loadDrillHistory (missing): got %v, %v; want no records", recs, err)
+	}
+
+	// Without a path, records are discarded.
+	if err := appendDrillHistory("", drillRecord{Set: "docs"}); err != nil {
+		t.Errorf("appendDrillHistory (no path): %v", err)
+	}
+
+	t0 := time.Date(2024, 4, 1, 9, 0, 0, 0, time.UTC)
+	want := []drillRecord{
+		{Time: t0, Set: "docs", Archive: "docs.1", Checked: 3, Content: 1},
+		{Time: t0.Add(time.Hour), Set: "pics", Archive: "pics.1", Checked: 2, Failures: []discrepancy{
+			{Entry: "pics/a.jpg", Path: "/tmp/x/pics/a.jpg", Problem: "missing"},
+		}},
+	}
+	for _, rec := range want {
+		if err := appendDrillHistory(path, rec); err != nil {
+			t.Fatalf("appendDrillHistory: %v", err)
+		}
+	}
+	got, err := loadDrillHistory(path)
+	if err != nil {
+		t.Fatalf("loadDrillHistory: %v", err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Wrong drill history: (-want, +got)\n%s", diff)
+	}
+
+	// A corrupted history file is reported.
+	if err := os.WriteFile(path, []byte("{not json}\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if recs, err := loadDrillHistory(path); err == nil {
+		t.Errorf("loadDrillHistory (invalid): got %v, want error", recs)
+	}
+}
+
+func TestSummarizeDrills(t *testing.T) {
+	t0 := time.Date(2024, 4, 1, 9, 0, 0, 0, time.UTC)
+	fail := []discrepancy{{Entry: "x", Path: "x", Problem: "missing"}}
+	recs := []drillRecord{
+		{Time: t0, Set: "docs", Archive: "docs.1"},
+		{Time: t0.Add(1 * time.Hour), Set: "pics", Archive: "pics.1", Failures: fail},
+		{Time: t0.Add(2 * time.Hour), Set: "docs", Archive: "docs.2"},
+		{Time: t0.Add(3 * time.Hour), Set: "docs", Archive: "docs.3", Failures: fail},
+		{Time: t0.Add(4 * time.Hour), Set: "other", Archive: "other.1"},
+	}
+	got := summarizeDrills([]string{"docs", "pics", "misc"}, recs)
+	want := []*drillSummary{
+		// The last drill failed, but an earlier one passed.
+		{Set: "docs", Last: &recs[3], LastPassed: t0.Add(2 * time.Hour), Drills: 3},
+
+		// The only drill failed, so the set has never passed.
+		{Set: "pics", Last: &recs[1], Drills: 1},
+
+		// No drills have been run.
+		{Set: "misc"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Wrong drill summary: (-want, +got)\n%s", diff)
+	}
+}
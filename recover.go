@@ -0,0 +1,120 @@
+// Copyright (C) 2018 Michael J. Fromberger. All Rights Reserved.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/creachadair/mds/mapset"
+	"github.com/creachadair/snapback/config"
+	"github.com/creachadair/tarsnap"
+)
+
+// recoverSets restores the latest archive of each backup set into a
+// subdirectory of dir named for the set. It does not use the snapback
+// configuration, so that it works even if the configuration was lost: The
+// backup sets are inferred from the archive names, and tarsnap is run with
+// only the -keyfile given on the command line (or its own defaults).
+//
+// If -recover-config is set, the named set (which should contain the snapback
+// configuration file) is recovered before the others.
+func recoverSets(dir string) {
+	now := effectiveNow()
+	ts := &tarsnap.Config{
+		Keyfile: os.ExpandEnv(*keyFile),
+		CmdLog:  logCommand,
+	}
+	fmt.Fprintln(os.Stderr, "-- Listing available archives")
+	as, err := ts.List()
+	if err != nil {
+		log.Fatalf("Listing archives: %v", err)
+	}
+
+	// Group the archives by base name, and choose which to recover.
+	bases := mapset.New[string]()
+	for _, a := range as {
+		bases.Add(a.Base)
+	}
+	sets := bases.Slice()
+	if flag.NArg() != 0 {
+		want := mapset.New(flag.Args()...)
+		if !want.IsSubset(bases) {
+			log.Fatalf("No archives found for %s", want.RemoveAll(bases).Slice())
+		}
+		sets = want.Slice()
+	}
+	slices.Sort(sets)
+	if *recoverCfg != "" {
+		if !bases.Has(*recoverCfg) {
+			log.Fatalf("No archives found for configuration set %q", *recoverCfg)
+		}
+		sets = slices.DeleteFunc(sets, func(s string) bool { return s == *recoverCfg })
+		sets = append([]string{*recoverCfg}, sets...)
+	}
+
+	type recovered struct {
+		Set     string `json:"set"`
+		Archive string `json:"archive"`
+		Dir     string `json:"dir"`
+		WorkDir string `json:"workDir,omitempty"` // from the manifest
+	}
+	var done []recovered
+	var man *config.Manifest
+	for _, set := range sets {
+		arch, ok := tarsnap.Archives(as).LatestAsOf(set, now)
+		if !ok {
+			log.Printf("[WARNING] No %q archive found as of %v", set, now.Format(time.RFC3339))
+			continue
+		}
+		out := filepath.Join(dir, set)
+		fmt.Fprintf(os.Stderr, "-- Recovering %q into %q\n", arch.Name, out)
+		if *doDryRun {
+			fmt.Fprintln(os.Stderr, "[dry run, not restoring]")
+		} else if err := ts.Extract(arch.Name, tarsnap.ExtractOptions{
+			WorkDir:            out,
+			RestorePermissions: true,
+		}); err != nil {
+			log.Fatalf("Extracting from %q: %v", arch.Name, err)
+		}
+		r := recovered{Set: set, Archive: arch.Name, Dir: out}
+		if set == *recoverCfg {
+			fmt.Fprintf(os.Stderr, "-- Configuration recovered into %q\n", out)
+			if m, err := config.LoadManifest(filepath.Join(out, config.ManifestFile)); err == nil {
+				fmt.Fprintf(os.Stderr, "-- Using manifest from %q (host %q, created %v)\n",
+					arch.Name, m.Host, m.Created.Format(time.RFC3339))
+				man = m
+			}
+		} else if ms := man.FindSet(set); ms != nil {
+			fmt.Fprintf(os.Stderr, "-- Set %q was backed up from %q\n", set, ms.WorkDir)
+			r.WorkDir = ms.WorkDir
+			if !*doDryRun {
+				b := ms.Backup()
+				for _, inc := range ms.Include {
+					if err := relocate(out, b, b.ArchiveName(inc)); err != nil {
+						log.Printf("[WARNING] Unable to relocate %q: %v", inc, err)
+					}
+				}
+			}
+		}
+		done = append(done, r)
+	}
+	if *doJSON {
+		bits, _ := json.Marshal(struct {
+			N time.Time   `json:"now"`
+			R []recovered `json:"recovered"`
+			D bool        `json:"dryRun,omitempty"`
+		}{N: now.In(time.UTC), R: done, D: *doDryRun})
+		fmt.Println(string(bits))
+	} else {
+		for _, r := range done {
+			fmt.Println(r.Archive)
+		}
+	}
+}
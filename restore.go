@@ -0,0 +1,771 @@
+// Copyright (C) 2018 Michael J. Fromberger. All Rights Reserved.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/creachadair/atomicfile"
+	"github.com/creachadair/mds/mapset"
+	"github.com/creachadair/snapback/config"
+	"github.com/creachadair/tarsnap"
+)
+
+func restoreFiles(cfg *config.Config, dir string) {
+	if flag.NArg() == 0 && !*doInPlace && (*setName != "" || *fromArch != "") {
+		restoreSet(cfg, dir)
+		return
+	} else if flag.NArg() == 0 {
+		log.Fatal("No paths were specified to -restore")
+	}
+	now := effectiveNow()
+	if *doInPlace {
+		if dir != "" {
+			log.Fatal("You may not combine -in-place with an output directory")
+		} else if !slices.Contains(conflictPolicies, *onConflict) {
+			log.Fatalf("Unknown -conflict policy %q (want one of %s)",
+				*onConflict, strings.Join(conflictPolicies, ", "))
+		}
+	}
+
+	checkArchiveFlags(cfg)
+
+	// Locate the backup sets that claim each requested path.
+	type request struct {
+		path string              // the path as given by the user
+		bs   []config.BackupPath // candidate backup sets
+	}
+	var reqs []request
+	for _, path := range flag.Args() {
+		reqs = append(reqs, request{path: path, bs: findBackups(cfg, path)})
+	}
+
+	// Now that we have something to restore, it's worth listing the archives.
+	fmt.Fprintln(os.Stderr, "-- Listing available archives")
+	as, err := cfg.List()
+	if err != nil {
+		log.Fatalf("Listing archives: %v", err)
+	}
+
+	// Choose which backup sets to restore each path from. If a path is claimed
+	// by more than one set, use all of them with -all-sets, or otherwise the one
+	// whose latest archive as of now is the newest.
+	need := make(map[string][]string) // :: base → paths
+	slow := mapset.New[string]()
+	for _, req := range reqs {
+		bs := req.bs
+		if len(bs) > 1 && !*doAllSets {
+			bs = []config.BackupPath{newestBackup(as, req.path, bs, now)}
+		}
+		for _, b := range bs {
+			n := b.Backup.Name
+
+			// If possible, we'll use fast reads to avoid having to scan the whole
+			// archive.  But we can only do this if the user did not request the
+			// restoration of directories or globs.
+			if strings.HasSuffix(req.path, "/") || isGlob(req.path) {
+				slow.Add(n)
+			}
+			need[n] = append(need[n], b.Archive)
+		}
+	}
+
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			log.Fatalf("Creating output directory: %v", err)
+		}
+	}
+
+	// Choose the archive to restore each path from. Ordinarily this is the
+	// latest archive of the set, but when undeleting each path may come from a
+	// different (older) archive.
+	type restore struct {
+		arch  tarsnap.Archive
+		paths []string
+	}
+	plan := make(map[string]*restore) // :: archive name → restore
+	addPaths := func(arch tarsnap.Archive, paths ...string) {
+		if plan[arch.Name] == nil {
+			plan[arch.Name] = &restore{arch: arch}
+		}
+		plan[arch.Name].paths = append(plan[arch.Name].paths, paths...)
+	}
+	for set, paths := range need {
+		arch := selectArchive(as, set, now)
+		if !*doUndelete {
+			addPaths(arch, paths...)
+			continue
+		}
+		for _, path := range paths {
+			if isGlob(path) {
+				log.Fatalf("Cannot undelete glob %q", path)
+			}
+			src, ok, err := findLastContaining(cfg, as, arch, path)
+			if err != nil {
+				log.Fatalf("Searching for %q: %v", path, err)
+			} else if !ok {
+				log.Fatalf("No %q archive contains %q", set, path)
+			}
+			fmt.Fprintf(os.Stderr, "-- Found %q in %q\n", path, src.Name)
+			addPaths(src, path)
+		}
+	}
+
+	type restored struct {
+		Archive    string        `json:"archive"`
+		Dir        string        `json:"dir,omitempty"`
+		Paths      []string      `json:"paths"`
+		Mismatches []discrepancy `json:"mismatches,omitempty"`
+	}
+	var done []restored
+	var mismatches []discrepancy
+	names := slices.Sorted(maps.Keys(plan))
+	for _, name := range names {
+		r := plan[name]
+		opts := tarsnap.ExtractOptions{
+			Include:            sortedUnique(r.paths),
+			WorkDir:            dir,
+			RestorePermissions: true,
+			FastRead:           !slow.Has(r.arch.Base),
+		}
+		if *doInPlace {
+			bad, err := restoreInPlace(cfg, r.arch, opts)
+			if err != nil {
+				log.Fatalf("Restoring from %q in place: %v", name, err)
+			}
+			mismatches = append(mismatches, bad...)
+			done = append(done, restored{Archive: name, Paths: opts.Include, Mismatches: bad})
+			continue
+		} else if *doAllSets {
+			opts.WorkDir = filepath.Join(dir, r.arch.Base)
+		}
+		fmt.Fprintf(os.Stderr, "-- Restoring from %q into %q\n » %s\n",
+			name, opts.WorkDir, strings.Join(opts.Include, "\n » "))
+		var bad []discrepancy
+		if *doDryRun {
+			fmt.Fprintln(os.Stderr, "[dry run, not restoring]")
+		} else if err := cfg.Config.Extract(name, opts); err != nil {
+			log.Fatalf("Extracting from %q: %v", name, err)
+		} else {
+			b := cfg.FindSet(r.arch.Base)
+			for _, path := range opts.Include {
+				if err := relocate(opts.WorkDir, b, path); err != nil {
+					log.Printf("[WARNING] Unable to relocate %q: %v", path, err)
+				}
+			}
+			if *doVerify {
+				bad, err = verifyEntries(cfg, name, func(e *tarsnap.Entry) string {
+					if !matchesInclude(e.Name, opts.Include) {
+						return ""
+					}
+					return restoredPath(opts.WorkDir, b, e.Name)
+				})
+				if err != nil {
+					log.Fatalf("Listing entries for %q: %v", name, err)
+				}
+				mismatches = append(mismatches, bad...)
+			}
+		}
+		done = append(done, restored{Archive: name, Dir: opts.WorkDir, Paths: opts.Include, Mismatches: bad})
+	}
+	if *doJSON {
+		bits, _ := json.Marshal(struct {
+			N time.Time  `json:"now"`
+			R []restored `json:"restored"`
+			D bool       `json:"dryRun,omitempty"`
+		}{N: now.In(time.UTC), R: done, D: *doDryRun})
+		fmt.Println(string(bits))
+	}
+	reportMismatches(mismatches)
+}
+
+// checkArchiveFlags checks the consistency of the flags that select which
+// backup set and archive to read from.
+func checkArchiveFlags(cfg *config.Config) {
+	if *fromArch != "" && *selectSpec != "" {
+		log.Fatal("You may not combine -from with -select")
+	} else if *setName != "" && cfg.FindSet(*setName) == nil {
+		log.Fatalf("No such backup set %q", *setName)
+	}
+}
+
+// findBackups returns the backup sets that claim path. If -from is set, only
+// the set of that archive is considered, and if -set is set only that set. It
+// is an error if no backup set is found.
+func findBackups(cfg *config.Config, path string) []config.BackupPath {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		log.Fatalf("Unable to resolve %q: %v", path, err)
+	}
+	bs := cfg.FindPath(abs)
+	if len(bs) == 0 {
+		log.Fatalf("No backups found for %q", path)
+	} else if *fromArch != "" {
+		// Every path is restored from that archive, and so must belong to the
+		// backup set the archive was created for.
+		fromSet := archiveBase(*fromArch)
+		bs = slices.DeleteFunc(bs, func(b config.BackupPath) bool {
+			return b.Backup.Name != fromSet
+		})
+		if len(bs) == 0 {
+			log.Fatalf("Backup set %q of archive %q does not include %q", fromSet, *fromArch, path)
+		}
+	} else if *setName != "" {
+		bs = slices.DeleteFunc(bs, func(b config.BackupPath) bool {
+			return b.Backup.Name != *setName
+		})
+		if len(bs) == 0 {
+			log.Fatalf("Backup set %q does not include %q", *setName, path)
+		}
+	}
+	return bs
+}
+
+// catFiles writes the contents of the files named by the non-flag arguments
+// to stdout, from the latest archive (or as selected by -from or -select) of
+// the backup set containing each.
+func catFiles(cfg *config.Config) {
+	if flag.NArg() == 0 {
+		log.Fatal("No paths were specified to -cat")
+	}
+	now := effectiveNow()
+	checkArchiveFlags(cfg)
+	for _, path := range flag.Args() {
+		if strings.HasSuffix(path, "/") || isGlob(path) {
+			log.Fatalf("Cannot -cat %q (not a single file)", path)
+		}
+	}
+	as, err := cfg.List()
+	if err != nil {
+		log.Fatalf("Listing archives: %v", err)
+	}
+	for _, path := range flag.Args() {
+		bs := findBackups(cfg, path)
+		b := bs[0]
+		if len(bs) > 1 {
+			b = newestBackup(as, path, bs, now)
+		}
+		arch := selectArchive(as, b.Backup.Name, now)
+		fmt.Fprintf(os.Stderr, "-- Reading %q from %q\n", b.Archive, arch.Name)
+
+		// The tarsnap package does not support extraction to stdout, so we run
+		// the tool directly.
+		cmd := tarsnapCommand(&cfg.Config, "-x", "-O", "--fast-read", "-f", arch.Name, "--", b.Archive)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			log.Fatalf("Reading %q from %q: %v", b.Archive, arch.Name, err)
+		}
+	}
+}
+
+// restoreSet restores the complete contents of an archive of the backup set
+// named by -set or -from into dir, and reports statistics for each of the
+// include paths of the set.
+func restoreSet(cfg *config.Config, dir string) {
+	now := effectiveNow()
+	set := *setName
+	if *fromArch != "" {
+		if fromSet := archiveBase(*fromArch); set == "" {
+			set = fromSet
+		} else if set != fromSet {
+			log.Fatalf("Archive %q does not belong to backup set %q", *fromArch, set)
+		}
+	}
+	b := cfg.FindSet(set)
+	if b == nil {
+		log.Fatalf("No such backup set %q", set)
+	}
+	b.ExpandIncludes(cfg.WorkDir)
+
+	fmt.Fprintln(os.Stderr, "-- Listing available archives")
+	as, err := cfg.List()
+	if err != nil {
+		log.Fatalf("Listing archives: %v", err)
+	}
+	arch := selectArchive(as, set, now)
+	opts := tarsnap.ExtractOptions{
+		WorkDir:            dir,
+		RestorePermissions: true,
+	}
+	fmt.Fprintf(os.Stderr, "-- Restoring all of %q into %q\n", arch.Name, dir)
+	if *doDryRun {
+		fmt.Fprintln(os.Stderr, "[dry run, not restoring]")
+	} else if err := cfg.Config.Extract(arch.Name, opts); err != nil {
+		log.Fatalf("Extracting from %q: %v", arch.Name, err)
+	}
+
+	// Relocate and summarize the contents restored for each include path.
+	type includeStats struct {
+		Include string `json:"include"`
+		Files   int    `json:"files"`
+		Bytes   int64  `json:"bytes"`
+	}
+	var stats []includeStats
+	for _, inc := range b.Include {
+		st := includeStats{Include: inc}
+		if !*doDryRun {
+			if err := relocate(dir, b, b.ArchiveName(inc)); err != nil {
+				log.Printf("[WARNING] Unable to relocate %q: %v", inc, err)
+			}
+			root := filepath.Join(dir, strings.TrimLeft(inc, "/"))
+			filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+				if err == nil && d.Type().IsRegular() {
+					if fi, err := d.Info(); err == nil {
+						st.Files++
+						st.Bytes += fi.Size()
+					}
+				}
+				return nil
+			})
+		}
+		stats = append(stats, st)
+	}
+	var bad []discrepancy
+	if *doVerify && !*doDryRun {
+		bad, err = verifyEntries(cfg, arch.Name, func(e *tarsnap.Entry) string {
+			return restoredPath(dir, b, e.Name)
+		})
+		if err != nil {
+			log.Fatalf("Listing entries for %q: %v", arch.Name, err)
+		}
+	}
+	if *doJSON {
+		bits, _ := json.Marshal(struct {
+			N time.Time      `json:"now"`
+			A string         `json:"archive"`
+			D string         `json:"dir"`
+			S []includeStats `json:"includes"`
+			M []discrepancy  `json:"mismatches,omitempty"`
+			R bool           `json:"dryRun,omitempty"`
+		}{N: now.In(time.UTC), A: arch.Name, D: dir, S: stats, M: bad, R: *doDryRun})
+		fmt.Println(string(bits))
+	} else if !*doDryRun {
+		tw := tabwriter.NewWriter(os.Stdout, 0, 8, 3, ' ', 0)
+		for _, st := range stats {
+			fmt.Fprintf(tw, "%s\t%d files\t%s\n", st.Include, st.Files, H(st.Bytes))
+		}
+		tw.Flush()
+	}
+	reportMismatches(bad)
+}
+
+// newestBackup returns the element of bs whose latest archive as of now is the
+// most recently created. The path is the original path being restored.
+func newestBackup(as tarsnap.Archives, path string, bs []config.BackupPath, now time.Time) config.BackupPath {
+	var best config.BackupPath
+	var bestArch tarsnap.Archive
+	var names []string
+	for _, b := range bs {
+		names = append(names, b.Backup.Name)
+		arch, ok := as.LatestAsOf(b.Backup.Name, now)
+		if ok && (best.Backup == nil || arch.Created.After(bestArch.Created)) {
+			best, bestArch = b, arch
+		}
+	}
+	if best.Backup == nil {
+		log.Fatalf("No archives found for %q in backup sets %s", path, strings.Join(names, ", "))
+	}
+	fmt.Fprintf(os.Stderr, "-- %q is in backup sets %s; using %q (newest archive %q)\n",
+		path, strings.Join(names, ", "), best.Backup.Name, bestArch.Name)
+	return best
+}
+
+// archiveBase returns the name of the backup set to which the specified archive
+// name or selector refers. A name that does not parse as a selector is treated
+// as the exact name of an archive, which may contain "@" or "~".
+func archiveBase(name string) string {
+	sel, err := config.ParseSelector(name)
+	if !config.IsSelector(name) || err != nil {
+		base, _, _ := strings.Cut(name, ".")
+		return base
+	} else if sel.Set == "" {
+		log.Fatalf("Selector %q does not specify a backup set", name)
+	}
+	return sel.Set
+}
+
+// selectArchive returns the archive of the specified set to restore from.
+// This is the latest archive as of now, unless -from or -select is set.
+func selectArchive(as tarsnap.Archives, set string, now time.Time) tarsnap.Archive {
+	if *fromArch != "" {
+		arch := resolveArchive(as, *fromArch)
+		if arch.Base != set {
+			log.Fatalf("Archive %q does not belong to backup set %q", arch.Name, set)
+		}
+		return arch
+	} else if *selectSpec == "" {
+		arch, ok := as.LatestAsOf(set, now)
+		if !ok {
+			log.Fatalf("Unable to find the latest %q archive", set)
+		}
+		return arch
+	}
+	sel, err := config.ParseSelector(*selectSpec)
+	if err != nil {
+		log.Fatalf("Invalid selector: %v", err)
+	} else if sel.Name != "" {
+		log.Fatalf("Invalid selector %q (use set@when or set~N)", *selectSpec)
+	} else if sel.Set == "" {
+		sel.Set = set
+	} else if sel.Set != set {
+		log.Fatalf("Selector %q does not match backup set %q", *selectSpec, set)
+	}
+	arch, err := sel.Resolve(as, now)
+	if err != nil {
+		log.Fatalf("Resolving %q: %v", *selectSpec, err)
+	}
+	return arch
+}
+
+// findLastContaining searches backward through the archives of the same set as
+// latest, beginning at latest, and returns the most recent archive containing
+// an entry for path. It reports false if no such archive is found.
+func findLastContaining(cfg *config.Config, as tarsnap.Archives, latest tarsnap.Archive, path string) (tarsnap.Archive, bool, error) {
+	for i := len(as) - 1; i >= 0; i-- {
+		a := as[i]
+		if a.Base != latest.Base || a.Created.After(latest.Created) {
+			continue
+		}
+		e, err := findEntry(cfg, a.Name, path)
+		if err != nil {
+			return tarsnap.Archive{}, false, err
+		} else if e != nil {
+			return a, true, nil
+		}
+		fmt.Fprintf(os.Stderr, "-- %q is not in %q\n", path, a.Name)
+	}
+	return tarsnap.Archive{}, false, nil
+}
+
+// relocate moves the files extracted into root for the archive entry name of
+// backup b to the paths they had on the local filesystem, relative to root.
+// This reverses the substitution rules of b, if any, so that restored files
+// have their original layout.
+func relocate(root string, b *config.Backup, name string) error {
+	if len(b.Modify) == 0 || isGlob(name) {
+		return nil // nothing to do, or no way to tell
+	}
+
+	// Tarsnap removes the leading "/" from absolute paths on extraction, even
+	// if they were preserved in the archive.
+	abs := strings.HasPrefix(name, "/")
+	src := filepath.Join(root, strings.TrimLeft(name, "/"))
+
+	// Collect the moves first, so that moving one file does not affect which
+	// files the walk visits.
+	type move struct{ src, dst string }
+	var moves []move
+	if err := filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if abs {
+			rel = "/" + rel
+		}
+		local, ok := b.LocalName(rel)
+		if !ok {
+			log.Printf("[WARNING] Cannot determine the original path of %q", rel)
+			return nil
+		}
+		if dst := filepath.Join(root, strings.TrimLeft(local, "/")); dst != path {
+			moves = append(moves, move{src: path, dst: dst})
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, m := range moves {
+		fmt.Fprintf(os.Stderr, "-- Relocating %q to %q\n", m.src, m.dst)
+		if err := os.MkdirAll(filepath.Dir(m.dst), 0700); err != nil {
+			return err
+		} else if err := os.Rename(m.src, m.dst); err != nil {
+			return err
+		}
+	}
+
+	// Clean up any directories left empty by relocation, deepest first, up to
+	// but not including root. This includes the parents of src, when src is a
+	// single file. Removal fails for directories that are not empty, which is
+	// fine.
+	emptied := mapset.New[string]()
+	top := filepath.Clean(root)
+	for _, m := range moves {
+		for d := filepath.Dir(m.src); d != top && d != "." && d != "/"; d = filepath.Dir(d) {
+			emptied.Add(d)
+		}
+	}
+	dirs := emptied.Slice()
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	for _, d := range dirs {
+		os.Remove(d)
+	}
+	return nil
+}
+
+// Policies for resolving conflicts between restored and existing files.
+var conflictPolicies = []string{"skip", "overwrite", "newer", "keep-both"}
+
+// restoreInPlace restores the files selected by opts from arch to their
+// original locations, resolving conflicts with existing files according to
+// the -conflict policy. The files are first extracted into a staging
+// directory, then moved into place. With -verify, it returns the restored files
+// that do not match the archive. Entries whose original path cannot be
+// determined, or is ambiguous, are reported and skipped, since writing them in
+// place might replace an unrelated file.
+func restoreInPlace(cfg *config.Config, arch tarsnap.Archive, opts tarsnap.ExtractOptions) ([]discrepancy, error) {
+	b := cfg.FindSet(arch.Base)
+	base := b.Dir(cfg.WorkDir)
+	for _, path := range opts.Include {
+		if isGlob(path) {
+			return nil, fmt.Errorf("cannot restore glob %q in place", path)
+		}
+	}
+
+	// Find the entries to restore, and decide where each one should go.
+	type target struct {
+		entry  *tarsnap.Entry
+		dst    string // the destination path, or "" to skip
+		action string
+	}
+	var targets []target
+	var unknown int
+	dirModes := make(map[string]fs.FileMode) // :: archive name → mode
+	fmt.Fprintf(os.Stderr, "-- Scanning %q for files to restore in place\n", arch.Name)
+	if err := cfg.Entries(arch.Name, func(e *tarsnap.Entry) error {
+		if e.Mode.IsDir() {
+			dirModes[strings.TrimSuffix(e.Name, "/")] = e.Mode.Perm()
+			return nil
+		} else if !matchesInclude(e.Name, opts.Include) {
+			return nil
+		}
+		local, ok := b.LocalName(e.Name)
+		if !ok {
+			targets = append(targets, target{entry: e, action: "skip (unknown original path)"})
+			unknown++
+			return nil
+		}
+		if !filepath.IsAbs(local) {
+			local = filepath.Join(base, local)
+		}
+		dst, action, err := resolveConflict(local, e.ModTime, *onConflict)
+		if err != nil {
+			return err
+		}
+		targets = append(targets, target{entry: e, dst: dst, action: action})
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("listing entries: %w", err)
+	}
+
+	var w io.Writer = os.Stdout
+	if *doJSON {
+		w = os.Stderr // keep stdout for the JSON summary
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 3, ' ', 0)
+	for _, t := range targets {
+		fmt.Fprint(tw, t.action, "\t", t.entry.Name, "\t", t.dst, "\n")
+	}
+	tw.Flush()
+	if unknown != 0 {
+		log.Printf("[WARNING] Skipped %d entries of %q whose original path is unknown or ambiguous; "+
+			"use -restore to extract them to a directory", unknown, arch.Name)
+	}
+	if *doDryRun {
+		fmt.Fprintln(os.Stderr, "[dry run, not restoring]")
+		return nil, nil
+	}
+
+	// Stage the extraction in the working directory of the backup, so that
+	// moving files into place does not usually cross devices. If that is not
+	// possible, use the system temporary directory and copy the files. The
+	// staging directory must be removed even if the restore fails, so that the
+	// restored copies are not included in the next backup.
+	stage, err := os.MkdirTemp(base, ".snapback-restore-")
+	if err != nil {
+		log.Printf("[WARNING] Cannot stage files in %q (%v); using a temporary directory", base, err)
+		stage, err = os.MkdirTemp("", "snapback-restore-")
+		if err != nil {
+			return nil, fmt.Errorf("creating staging directory: %w", err)
+		}
+	}
+	defer os.RemoveAll(stage)
+
+	// Directories created to hold restored files get their archived modes.
+	dirMode := func(dir string) fs.FileMode {
+		if rel, ok := strings.CutPrefix(dir, base+"/"); ok {
+			dir = rel
+		}
+		if mode, ok := dirModes[b.ArchiveName(dir)]; ok {
+			return mode
+		}
+		return 0700
+	}
+	opts.WorkDir = stage
+	fmt.Fprintf(os.Stderr, "-- Restoring from %q in place\n » %s\n",
+		arch.Name, strings.Join(opts.Include, "\n » "))
+	if err := cfg.Config.Extract(arch.Name, opts); err != nil {
+		return nil, fmt.Errorf("extracting: %w", err)
+	}
+	for _, t := range targets {
+		if t.dst == "" {
+			continue
+		}
+		src := filepath.Join(stage, strings.TrimLeft(t.entry.Name, "/"))
+		if err := moveFile(src, t.dst, dirMode); err != nil {
+			return nil, fmt.Errorf("moving %q into place: %w", t.entry.Name, err)
+		}
+	}
+	if !*doVerify {
+		return nil, nil
+	}
+
+	// The entries were already scanned to plan the restore, so there is no need
+	// to list them again.
+	var bad []discrepancy
+	for _, t := range targets {
+		if t.dst == "" {
+			continue
+		} else if d, ok := verifyFile(t.entry, t.dst); !ok {
+			bad = append(bad, d)
+		}
+	}
+	return bad, nil
+}
+
+// resolveConflict decides where to restore a file whose original path is dst
+// and whose archived modification time is modTime, according to the conflict
+// policy. It returns the destination path, or "" if the file should not be
+// restored, along with a description of the action taken.
+func resolveConflict(dst string, modTime time.Time, policy string) (string, string, error) {
+	fi, err := os.Lstat(dst)
+	if errors.Is(err, fs.ErrNotExist) {
+		return dst, "create", nil
+	} else if err != nil {
+		return "", "", err
+	}
+	switch policy {
+	case "overwrite":
+		return dst, "overwrite", nil
+	case "newer":
+		if modTime.After(fi.ModTime()) {
+			return dst, "overwrite (newer)", nil
+		}
+		return "", "skip (not newer)", nil
+	case "keep-both":
+		for i := 0; ; i++ {
+			alt := dst + ".restored"
+			if i > 0 {
+				alt += "." + strconv.Itoa(i)
+			}
+			if _, err := os.Lstat(alt); errors.Is(err, fs.ErrNotExist) {
+				return alt, "keep both", nil
+			} else if err != nil {
+				return "", "", err
+			}
+		}
+	default:
+		return "", "skip (exists)", nil
+	}
+}
+
+// moveFile moves the file at src to dst, creating the parent directories of
+// dst as needed with the permissions reported by dirMode. If src and dst are
+// on different devices, the file is copied and then src is removed.
+func moveFile(src, dst string, dirMode func(string) fs.FileMode) error {
+	if err := makeDirs(filepath.Dir(dst), dirMode); err != nil {
+		return err
+	}
+	err := os.Rename(src, dst)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	if err := copyFile(src, dst); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// makeDirs creates dir and any missing parents, outermost first, giving each
+// directory it creates the permissions reported by dirMode.
+func makeDirs(dir string, dirMode func(string) fs.FileMode) error {
+	if fi, err := os.Stat(dir); err == nil {
+		if !fi.IsDir() {
+			return fmt.Errorf("%q is not a directory", dir)
+		}
+		return nil
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if parent := filepath.Dir(dir); parent != dir {
+		if err := makeDirs(parent, dirMode); err != nil {
+			return err
+		}
+	}
+	mode := dirMode(dir)
+	if err := os.Mkdir(dir, mode); err != nil {
+		return err
+	}
+	return os.Chmod(dir, mode) // not subject to the umask
+}
+
+// copyFile copies the file at src to dst, replacing dst atomically if it
+// exists, and preserving the permissions and modification time of src.
+// Symbolic links are copied as links.
+func copyFile(src, dst string) error {
+	fi, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	switch {
+	case fi.Mode()&fs.ModeSymlink != 0:
+		target, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		tmp := dst + ".snapback-link"
+		if err := os.Symlink(target, tmp); err != nil {
+			return err
+		}
+		return os.Rename(tmp, dst)
+	case !fi.Mode().IsRegular():
+		return fmt.Errorf("cannot copy %q across devices (mode %v)", src, fi.Mode())
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := atomicfile.New(dst, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Cancel()
+		return err
+	} else if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Chtimes(dst, fi.ModTime(), fi.ModTime())
+}
@@ -0,0 +1,200 @@
+// Copyright (C) 2018 Michael J. Fromberger. All Rights Reserved.
+
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/creachadair/snapback/config"
+	"github.com/creachadair/tarsnap"
+)
+
+func TestResolveConflict(t *testing.T) {
+	dir := t.TempDir()
+	old := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	exists := filepath.Join(dir, "exists")
+	if err := os.WriteFile(exists, []byte("live"), 0600); err != nil {
+		t.Fatal(err)
+	} else if err := os.Chtimes(exists, old, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(exists+".restored", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(dir, "missing")
+
+	tests := []struct {
+		dst     string
+		modTime time.Time
+		policy  string
+		want    string
+		action  string
+	}{
+		{missing, old, "skip", missing, "create"},
+		{missing, old, "keep-both", missing, "create"},
+		{exists, old, "skip", "", "skip (exists)"},
+		{exists, old, "overwrite", exists, "overwrite"},
+		{exists, old, "newer", "", "skip (not newer)"},
+		{exists, old.Add(time.Hour), "newer", exists, "overwrite (newer)"},
+		{exists, old, "keep-both", exists + ".restored.1", "keep both"},
+	}
+	for _, test := range tests {
+		got, action, err := resolveConflict(test.dst, test.modTime, test.policy)
+		if err != nil {
+			t.Errorf("resolveConflict(%q, %s) failed: %v", test.dst, test.policy, err)
+		} else if got != test.want || action != test.action {
+			t.Errorf("resolveConflict(%q, %s): got (%q, %q), want (%q, %q)",
+				test.dst, test.policy, got, action, test.want, test.action)
+		}
+	}
+}
+
+func TestMoveFile(t *testing.T) {
+	dir := t.TempDir()
+	mtime := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	put := func(name, data string) string {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0640); err != nil {
+			t.Fatal(err)
+		} else if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	check := func(path, want string) {
+		t.Helper()
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("Reading %q: %v", path, err)
+		} else if string(data) != want {
+			t.Errorf("Contents of %q: got %q, want %q", path, data, want)
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != 0640 {
+			t.Errorf("Mode of %q: got %v, want 0640", path, fi.Mode().Perm())
+		}
+		if !fi.ModTime().Equal(mtime) {
+			t.Errorf("ModTime of %q: got %v, want %v", path, fi.ModTime(), mtime)
+		}
+	}
+
+	// Moving creates missing parent directories with the given modes, and
+	// replaces existing files.
+	modes := map[string]fs.FileMode{
+		filepath.Join(dir, "x"):      0750,
+		filepath.Join(dir, "x", "y"): 0711,
+	}
+	dirMode := func(d string) fs.FileMode {
+		if mode, ok := modes[d]; ok {
+			return mode
+		}
+		t.Errorf("Unexpected directory %q created", d)
+		return 0700
+	}
+	src := put("a", "alpha")
+	dst := filepath.Join(dir, "x", "y", "a")
+	if err := moveFile(src, dst, dirMode); err != nil {
+		t.Fatalf("moveFile: %v", err)
+	}
+	check(dst, "alpha")
+	for d, want := range modes {
+		if fi, err := os.Stat(d); err != nil {
+			t.Errorf("Stat %q: %v", d, err)
+		} else if got := fi.Mode().Perm(); got != want {
+			t.Errorf("Mode of %q: got %v, want %v", d, got, want)
+		}
+	}
+	if _, err := os.Lstat(src); !os.IsNotExist(err) {
+		t.Errorf("Source %q still exists after move: %v", src, err)
+	}
+	if err := moveFile(put("b", "bravo"), dst, dirMode); err != nil {
+		t.Fatalf("moveFile: %v", err)
+	}
+	check(dst, "bravo")
+
+	// Copying, used when a move crosses devices, replaces the target and
+	// preserves the mode and modification time.
+	if err := copyFile(put("c", "charlie"), dst); err != nil {
+		t.Fatalf("copyFile: %v", err)
+	}
+	check(dst, "charlie")
+	check(filepath.Join(dir, "c"), "charlie")
+
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink("a/b/c", link); err != nil {
+		t.Fatal(err)
+	}
+	if err := copyFile(link, dst); err != nil {
+		t.Fatalf("copyFile link: %v", err)
+	}
+	if got, err := os.Readlink(dst); err != nil || got != "a/b/c" {
+		t.Errorf("Readlink %q: got %q, %v; want a/b/c", dst, got, err)
+	}
+}
+
+func TestRelocate(t *testing.T) {
+	b := &config.Backup{
+		Name: "test",
+		CreateOptions: tarsnap.CreateOptions{
+			Include: []string{"src", "notes/todo.txt"},
+			Modify: []string{
+				`/^src/src-old/`,
+				`/^notes/notes-old/`,
+			},
+		},
+	}
+	root := t.TempDir()
+
+	// Simulate extraction of the archive entries into root.
+	extracted := []string{
+		"src-old/a.go",
+		"src-old/sub/b.go",
+		"notes-old/todo.txt",
+	}
+	for _, name := range extracted {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		} else if err := os.WriteFile(path, []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, inc := range b.Include {
+		if err := relocate(root, b, b.ArchiveName(inc)); err != nil {
+			t.Errorf("relocate %q: %v", inc, err)
+		}
+	}
+
+	// Each file is moved to its original path, for a directory include and
+	// for a single-file include.
+	for local, name := range map[string]string{
+		"src/a.go":       "src-old/a.go",
+		"src/sub/b.go":   "src-old/sub/b.go",
+		"notes/todo.txt": "notes-old/todo.txt",
+	} {
+		data, err := os.ReadFile(filepath.Join(root, local))
+		if err != nil {
+			t.Errorf("Reading %q: %v", local, err)
+		} else if string(data) != name {
+			t.Errorf("Contents of %q: got %q, want %q", local, data, name)
+		}
+	}
+
+	// Directories emptied by the moves are removed.
+	for _, dir := range []string{"src-old/sub", "src-old", "notes-old"} {
+		if _, err := os.Lstat(filepath.Join(root, dir)); !os.IsNotExist(err) {
+			t.Errorf("Directory %q still exists after relocation: %v", dir, err)
+		}
+	}
+	if _, err := os.Stat(root); err != nil {
+		t.Errorf("Root %q was removed: %v", root, err)
+	}
+}
@@ -7,6 +7,8 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"embed"
 	"encoding/json"
 	"errors"
@@ -15,13 +17,16 @@ import (
 	"io"
 	"io/fs"
 	"log"
+	"maps"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime/debug"
 	"slices"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"text/tabwriter"
 	"time"
 
@@ -40,37 +45,189 @@ func init() {
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, `Usage: %[1]s [-v]            # create new backups of all sets
        %[1]s -c <name>...    # create new backups of specified sets
+       %[1]s -cat <path>...  # write the contents of backed-up files to stdout
+       %[1]s -diff <a> <b>   # compare the contents of two archives
+       %[1]s -drill <n>      # test-restore a sample of files from each set
+       %[1]s -dump           # show the expiration policies in effect
        %[1]s -entries <name> # list the contents of specified archives
        %[1]s -find <path>... # find files in backups
+       %[1]s -history <path> # show backed-up versions of files
        %[1]s -list           # list existing backups
+       %[1]s -pending        # list archives marked for deletion by pruning
+       %[1]s -pin <name>...  # keep specified archives from being pruned
        %[1]s -prune          # clean up old backups
+       %[1]s -recover <dir>  # recover all sets to <dir> without a config
        %[1]s -restore <dir>  # restore files or directories to <dir>
+       %[1]s -in-place       # restore files or directories in place
        %[1]s -size           # show sizes of stored data
+       %[1]s -status         # report the results of restore drills
        %[1]s -update         # update the tool from the network
 
 Create tarsnap backups of important directories. With the -v flag, the
 underlying tarsnap commands will be logged to stderr. If -dry-run is true, no
 archives are created or deleted.
 
+With -cat, the non-flag arguments specify files whose contents are written to
+stdout from the latest backup, without creating any files. The -set, -from, and
+-select flags choose the backup set and archive as for -restore.
+
+With -diff, the non-flag arguments name two archives to compare, either as
+"<archiveA> <archiveB>" or as "<set> <timeA> <timeB>", where each time selects
+the latest archive of the set as of that time. Entries added, removed, or
+modified (by size or modification time) from A to B are reported.
+
 With -find, the non-flag arguments specify file or directory paths to locate.
 The output reports which backup sets contain each specified path. Paths that do
 not match any known backup are omitted unless -v is also given.
 
+With -history, the non-flag arguments specify file or directory paths whose
+backed-up versions should be listed. The archives of each set that claims a
+path are scanned in order of creation, and an archive is reported only when the
+path first appears, changes size or modification time, or disappears.
+
 With -list and -size, the non-flag arguments are used to select which archives
 to list or evaluate. Globs are permitted in these arguments.
 
+With -entries, -size, and -diff, an archive name may also be given as a
+selector relative to the archives of a backup set:
+
+   set@latest       the most recent archive of set
+   set~N            the Nth most recent archive of set (set~1 is the latest)
+   set@2024-03-01   the latest archive of set created on or before that date
+   set@-3d          the latest archive of set as of 3 days before -now
+
+An argument that exactly matches the name of an existing archive always refers
+to that archive, even if it contains "@" or "~".
+
+With -restore, the -from flag names a specific archive (or selector) to restore
+from; each path must belong to the backup set of that archive. Alternatively,
+the -select flag accepts a selector to choose the archive to restore from. The
+set name may be omitted (e.g., -select ~2), in which case the selector applies
+to the set containing each path.
+
+If a path is included by more than one backup set, -restore uses the set whose
+latest archive (as of -now) is the newest. Use -set to choose a specific set,
+or -all-sets to restore the path from every set that includes it. With
+-all-sets, the files from each set are restored into a subdirectory of the
+output directory named for that set.
+
+With -restore and -set, but no non-flag arguments, the entire contents of the
+latest archive of the named set (or the archive selected by -select or -from)
+are restored into the output directory, with permissions. The number of files
+and bytes restored for each include path of the set are reported.
+
+With -recover, the latest archive of every backup set is restored into a
+subdirectory of the specified directory named for the set. This does not read
+the configuration file, so that it can be used to recover after the loss of a
+machine: The backup sets are inferred from the archive names, and tarsnap is run
+with the key file given by -keyfile (if set). Non-flag arguments select which
+sets to recover; the default is all of them. If -recover-config names a set, it
+is recovered first, for example to restore the snapback configuration itself.
+If that set is the manifest set (see the "manifest" setting), the manifest it
+contains is used to undo path substitutions in the other sets, and to report
+the directory each set was originally backed up from.
+
+With -in-place, the non-flag arguments specify files or directories to restore
+to their original locations, rather than to an output directory. The -conflict
+flag determines what happens when a file to be restored already exists:
+
+   skip        leave the existing file alone (default)
+   overwrite   replace the existing file
+   newer       replace the existing file only if the archived copy is newer
+   keep-both   restore the archived copy alongside, with a ".restored" suffix
+
+With -dry-run, -in-place lists the files that would be restored and where,
+without changing anything.
+
 With -prune, archives filtered by expiration policies are deleted. Non-flag
 arguments specify archive sets to evaluate for pruning. Archive ages are pruned
 based on the current time. For testing, you may override this by setting -now.
-Use -dry-run to show what archives would be pruned without actually doing so.
+Use -dry-run to show what archives would be pruned without actually doing so,
+and an estimate of the space each deletion would free, by set and in total.
 Add -v or -vv to log the policy rule evaluations.
 
+When -prune is run from a terminal, the archives to be deleted are summarized
+by backup set, and you are asked to confirm before they are deleted. Set
+"confirm-prune" in the configuration to ask for confirmation on every prune,
+including automatic prunes and runs without a terminal; the answer is read from
+stdin, and if none is given nothing is pruned.
+
+If any expiration policy includes a "budget" rule, the sizes of the archives
+in sets with a budget are loaded (from the "size-cache" file, if set, or from
+tarsnap), and -prune -dry-run uses them to estimate the space freed.
+
+Pruning is refused if it would exceed the safety limits set by "prune-limits"
+in the configuration, either globally or for a backup set: leaving fewer than
+min-retained archives in a set, or deleting more than max-delete archives or
+max-delete-percent percent of a set in one run. Pruning never deletes the
+newest archive of a set. Pruning is also refused if the effective current time
+is earlier than the newest archive, or later than it by more than the
+"max-clock-skew" setting, since this suggests a bad clock or -now. Use -force to
+prune regardless of these limits. With -dry-run, exceeding the limits is
+reported as a warning and the preview is still shown. An automatic prune that
+exceeds the limits is skipped with a warning. Set "prune-anchor: newest" to compute the ages of the
+archives of each set relative to its newest archive rather than the current
+time.
+
+If the "prune-grace" setting is positive, pruning is done in two phases: Each
+expired archive is first marked for deletion in the file named by the
+"pending-file" setting, and is deleted by a later prune only once it has been
+pending for the grace period, and only if it is still expired. Use -pending to
+list the archives marked for deletion, and -cancel to cancel the pending
+deletion of the archives named by the non-flag arguments. A cancelled archive
+is not marked again until it is no longer expired (for example, because the
+policy changed); use -pin to keep it regardless.
+
+With -pin, the archives named by the non-flag arguments (names or selectors)
+are recorded in the file named by the "pin-file" setting, and are never pruned.
+Archives listed in the "pinned" setting are likewise never pruned. With no
+arguments, -pin lists the pinned archives. Use -unpin to remove pins from the
+pin file; pins in the configuration must be removed by editing it.
+
+The -now flag accepts a local time (2006-01-02T15:04:05), an RFC 3339 time
+with a zone offset, a date (2006-01-02, meaning midnight local time), or a time
+relative to the present such as "-2w" or "3 days ago". The resolved time is
+logged with -v, and included in JSON output.
+
 With -restore, the non-flag arguments specify files or directories to restore
 into the specified output directory from the most recent matching backup.
 The output directory is created if it does not exist. A path ending in "/"
 identifies a directory, which is fully restored with all its contents.
 Otherwise, it names a single file. To restore files from a different backup
-(rather than the most recent), use -now.
+(rather than the most recent), use -now or -select.
+
+With -restore and -undelete, each path is restored from the most recent archive
+of its set that contains it, searching backward from the latest archive as of
+-now. Use this to recover files that have been deleted locally, and are thus
+missing from the newest backups. Each path must name a file or directory, not a
+glob.
+
+With -verify, each file restored by -restore or -in-place is checked against
+the metadata recorded in the archive: regular files must have the archived
+size, mode, and modification time, and every restored entry must be present.
+Mismatches are reported, and the tool exits with an error if there are any.
+Verifying -restore requires listing the full contents of the archive.
+
+With -drill N, a restore drill is run for each backup set named by the non-flag
+arguments (default all). Up to N regular files are chosen at random from the
+latest archive of the set and restored into a temporary directory. A file that
+has not changed locally since it was archived (by size and modification time)
+is compared byte-for-byte with the live copy; otherwise it is checked against
+the archived size, mode, and modification time. The results are appended to
+the file named by the "drill-history" setting, and the tool exits with an error
+if any check fails. Only the latest archive of each set is sampled; older
+archives are not drilled.
+
+With -dump, the default expiration rules, the named policies, and the rules in
+effect for each backup set named by the non-flag arguments (default all) are
+printed in the compact policy syntax, for example:
+
+   latest 3; 1d..2w 1/day; 2w..6mo 1/week; >6mo none
+
+This syntax may also be used for the expiration settings in the configuration.
+
+With -status, the most recent drill result for each backup set, and the time
+it last passed a drill, are reported from the drill history.
 
 Options:
 `, filepath.Base(os.Args[0]))
@@ -89,19 +246,42 @@ var (
 	defaultConfig = "$HOME/.snapback"
 
 	configFile *string // set in main, so the generated default will take effect
+	configText []byte  // the contents of the configuration file, for the manifest
+	keyFile    = flag.String("keyfile", "", "Use this tarsnap key file (overrides the configuration)")
 	doJSON     = flag.Bool("json", false, "Write machine-readable output in JSON")
+	doAllSets  = flag.Bool("all-sets", false, "With -restore, restore paths from every backup set that includes them")
+	doCat      = flag.Bool("cat", false, "Write the contents of the specified files to stdout")
 	doCreate   = flag.Bool("c", false, "Create backups (default if no arguments are given)")
+	drillN     = flag.Int("drill", 0, "Test-restore this many randomly-chosen files from each set")
+	doDiff     = flag.Bool("diff", false, "Compare the contents of two archives")
+	doDump     = flag.Bool("dump", false, "Print the expiration policies in effect for each backup set")
 	doEntries  = flag.Bool("entries", false, "List the contents of the specified archives")
+	doInPlace  = flag.Bool("in-place", false, "Restore files to their original locations")
+	doForce    = flag.Bool("force", false, "With -prune, delete archives even if safety limits are exceeded")
 	doFind     = flag.Bool("find", false, "Find backups containing the specified paths")
+	doHistory  = flag.Bool("history", false, "Show the backed-up versions of the specified paths")
 	doList     = flag.Bool("list", false, "List known archives")
+	doPending  = flag.Bool("pending", false, "List archives marked for deletion by pruning")
+	doCancel   = flag.Bool("cancel", false, "Cancel the pending deletion of the specified archives")
+	doPin      = flag.Bool("pin", false, "Pin the specified archives so they are never pruned (or list pins)")
+	doUnpin    = flag.Bool("unpin", false, "Unpin the specified archives")
 	doPrune    = flag.Bool("prune", false, "Prune out-of-band archives")
+	recoverDir = flag.String("recover", "", "Recover the latest archive of every set to this directory, without a configuration")
+	recoverCfg = flag.String("recover-config", "", "With -recover, recover this set (containing the configuration) first")
+	doStatus   = flag.Bool("status", false, "Report the results of recent restore drills")
 	doRestore  = flag.String("restore", "", "Restore files to this directory")
 	doSize     = flag.Bool("size", false, "Print size statistics")
+	onConflict = flag.String("conflict", "skip", "With -in-place, how to handle existing files (skip, overwrite, newer, keep-both)")
+	fromArch   = flag.String("from", "", "With -restore, restore from this archive")
+	setName    = flag.String("set", "", "With -restore, restore from this backup set (or all of it, if no paths are given)")
+	selectSpec = flag.String("select", "", "With -restore, select archives by this selector (e.g., @latest, ~2, @-3d)")
+	doUndelete = flag.Bool("undelete", false, "With -restore, use the latest archive containing each path")
 	doDryRun   = flag.Bool("dry-run", false, "Simulate creating or deleting archives")
+	doVerify   = flag.Bool("verify", false, "With -restore or -in-place, check restored files against the archive")
 	doUpdate   = flag.Bool("update", false, "Update the tool from the network")
 	doVerbose  = flag.Bool("v", false, "Verbose logging")
 	doVVerbose = flag.Bool("vv", false, "Extra verbose logging")
-	snapTime   = flag.String("now", "", "Effective current time ("+timeFormat+"; default is wallclock time)")
+	snapTime   = flag.String("now", "", "Effective current time ("+timeFormat+", RFC 3339, date, or relative; default is wallclock time)")
 )
 
 func main() {
@@ -114,6 +294,10 @@ func main() {
 		checkUpdate()
 		return
 	}
+	if *recoverDir != "" {
+		recoverSets(*recoverDir)
+		return
+	}
 	dir, cfg, err := loadConfig(*configFile)
 	if err != nil {
 		log.Fatalf("Loading configuration: %v", err)
@@ -128,6 +312,9 @@ func main() {
 	}
 	ts := &cfg.Config
 	ts.CmdLog = logCommand
+	if *keyFile != "" {
+		ts.Keyfile = os.ExpandEnv(*keyFile)
+	}
 	if ts.WorkDir == "" {
 		ts.WorkDir = dir
 	}
@@ -147,9 +334,11 @@ func main() {
 
 	// If we need a list of existing archives, grab it.  For size calculations
 	// we only need the full archive listing if the user has given us globs to
-	// select names from.
+	// select names from. Archive selectors also require a listing to resolve.
 	var arch []tarsnap.Archive
-	if *doList || *doPrune || (*doSize && hasGlob(flag.Args())) {
+	if *doList || *doPrune || *doHistory || *drillN > 0 || ((*doPin || *doUnpin) && flag.NArg() != 0) || (*doDiff && flag.NArg() == 3) ||
+		(*doSize && hasGlob(flag.Args())) ||
+		((*doSize || *doEntries || *doDiff) && hasSelector(flag.Args())) {
 		arch, err = cfg.List()
 		if err != nil {
 			log.Fatalf("Listing archives: %v", err)
@@ -159,6 +348,10 @@ func main() {
 		findArchives(cfg, arch)
 		return
 	}
+	if *doHistory {
+		fileHistory(cfg, arch)
+		return
+	}
 	if *doList {
 		listArchives(cfg, arch)
 		return
@@ -167,11 +360,41 @@ func main() {
 		listEntries(cfg, arch)
 		return
 	}
+	if *doDiff {
+		diffArchives(cfg, arch)
+		return
+	}
 	if *doPrune {
 		pruneArchives(cfg, arch)
 		return
 	}
-	if *doRestore != "" {
+	if *doPending || *doCancel {
+		listPending(cfg, *doCancel)
+		return
+	}
+	if *doPin || *doUnpin {
+		pinArchives(cfg, arch, *doUnpin)
+		return
+	}
+	if *drillN > 0 {
+		if err := restoreDrill(cfg, arch, *drillN); err != nil {
+			log.Fatalf("Drill: %v", err)
+		}
+		return
+	}
+	if *doStatus {
+		drillStatus(cfg)
+		return
+	}
+	if *doDump {
+		dumpPolicies(cfg)
+		return
+	}
+	if *doCat {
+		catFiles(cfg)
+		return
+	}
+	if *doRestore != "" || *doInPlace {
 		restoreFiles(cfg, *doRestore)
 		return
 	}
@@ -243,11 +466,11 @@ func findArchives(cfg *config.Config, _ []tarsnap.Archive) {
 	}
 }
 
-func listEntries(cfg *config.Config, _ []tarsnap.Archive) {
+func listEntries(cfg *config.Config, as []tarsnap.Archive) {
 	if flag.NArg() == 0 {
 		log.Fatal("No archives were specified to list -entries")
 	}
-	for _, arch := range flag.Args() {
+	for _, arch := range resolveArchives(as, flag.Args()) {
 		if err := cfg.Entries(arch, func(e *tarsnap.Entry) error {
 			if *doJSON {
 				bits, _ := json.Marshal(struct {
@@ -266,6 +489,179 @@ func listEntries(cfg *config.Config, _ []tarsnap.Archive) {
 	}
 }
 
+func fileHistory(cfg *config.Config, as []tarsnap.Archive) {
+	if flag.NArg() == 0 {
+		log.Fatal("No paths were specified to -history")
+	}
+	var w io.Writer = os.Stdout
+	if !*doJSON {
+		tw := tabwriter.NewWriter(os.Stdout, 0, 8, 3, ' ', 0)
+		defer tw.Flush()
+		w = tw
+	}
+	type version struct {
+		Path    string    `json:"path"`
+		Set     string    `json:"set"`
+		Archive string    `json:"archive"`
+		Created time.Time `json:"created"`
+		Status  string    `json:"status"`
+		Size    int64     `json:"size,omitempty"`
+		ModTime time.Time `json:"modTime,omitzero"`
+	}
+	for _, path := range flag.Args() {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			log.Fatalf("Unable to resolve %q: %v", path, err)
+		}
+		bs := cfg.FindPath(abs)
+		if len(bs) == 0 {
+			log.Fatalf("No backups found for %q", path)
+		}
+		for _, b := range bs {
+			name := b.Archive
+			fmt.Fprintf(os.Stderr, "-- Scanning %q archives for %q\n", b.Backup.Name, name)
+
+			var prev *tarsnap.Entry
+			for _, a := range as {
+				if a.Base != b.Backup.Name {
+					continue
+				}
+				cur, err := findEntry(cfg, a.Name, name)
+				if err != nil {
+					log.Fatalf("Listing entries for %q: %v", a.Name, err)
+				}
+				v := version{Path: abs, Set: a.Base, Archive: a.Name, Created: a.Created}
+				switch {
+				case cur == nil && prev == nil:
+					continue // still absent
+				case cur == nil:
+					v.Status = "deleted"
+				case prev == nil:
+					v.Status = "added"
+				case cur.Size != prev.Size || !cur.ModTime.Equal(prev.ModTime):
+					v.Status = "modified"
+				default:
+					continue // unchanged
+				}
+				prev = cur
+				if cur != nil {
+					v.Size, v.ModTime = cur.Size, cur.ModTime
+				}
+
+				if *doJSON {
+					bits, _ := json.Marshal(v)
+					fmt.Fprintln(w, string(bits))
+				} else if cur == nil {
+					fmt.Fprint(w, v.Archive, "\t", v.Status, "\t-\t-\n")
+				} else {
+					fmt.Fprint(w, v.Archive, "\t", v.Status, "\t", H(v.Size), "\t",
+						v.ModTime.In(time.Local).Format(timeFormat), "\n")
+				}
+			}
+		}
+	}
+}
+
+func diffArchives(cfg *config.Config, as []tarsnap.Archive) {
+	now := effectiveNow()
+	var lhs, rhs string
+	var lhsTime, rhsTime time.Time // resolved times, for the set/time form
+	switch flag.NArg() {
+	case 2:
+		names := resolveArchives(as, flag.Args())
+		lhs, rhs = names[0], names[1]
+	case 3:
+		set := flag.Arg(0)
+		find := func(s string) (string, time.Time) {
+			when, err := config.ParseTime(s, now)
+			if err != nil {
+				log.Fatalf("Invalid time %q: %v", s, err)
+			}
+			if *doVerbose || *doVVerbose {
+				log.Printf("Time %q is %v", s, when.Format(time.RFC3339))
+			}
+			arch, ok := tarsnap.Archives(as).LatestAsOf(set, when)
+			if !ok {
+				log.Fatalf("No %q archive found as of %v", set, when)
+			}
+			return arch.Name, when
+		}
+		lhs, lhsTime = find(flag.Arg(1))
+		rhs, rhsTime = find(flag.Arg(2))
+	default:
+		log.Fatal("Usage: -diff <archiveA> <archiveB> | <set> <timeA> <timeB>")
+	}
+	fmt.Fprintf(os.Stderr, "-- Comparing %q to %q\n", lhs, rhs)
+
+	old := make(map[string]*tarsnap.Entry)
+	if err := cfg.Entries(lhs, func(e *tarsnap.Entry) error {
+		old[e.Name] = e
+		return nil
+	}); err != nil {
+		log.Fatalf("Listing entries for %q: %v", lhs, err)
+	}
+
+	type change struct {
+		Name    string    `json:"name"`
+		Size    int64     `json:"size"`
+		ModTime time.Time `json:"modTime"`
+	}
+	var added, removed, modified []change
+	if err := cfg.Entries(rhs, func(e *tarsnap.Entry) error {
+		c := change{Name: e.Name, Size: e.Size, ModTime: e.ModTime}
+		if o, ok := old[e.Name]; !ok {
+			added = append(added, c)
+		} else {
+			delete(old, e.Name)
+			if o.Size != e.Size || !o.ModTime.Equal(e.ModTime) {
+				modified = append(modified, c)
+			}
+		}
+		return nil
+	}); err != nil {
+		log.Fatalf("Listing entries for %q: %v", rhs, err)
+	}
+	for _, name := range slices.Sorted(maps.Keys(old)) {
+		e := old[name]
+		removed = append(removed, change{Name: e.Name, Size: e.Size, ModTime: e.ModTime})
+	}
+
+	if *doJSON {
+		bits, _ := json.Marshal(struct {
+			Now      time.Time `json:"now"`
+			From     string    `json:"from"`
+			FromTime time.Time `json:"fromTime,omitzero"`
+			To       string    `json:"to"`
+			ToTime   time.Time `json:"toTime,omitzero"`
+			Added    []change  `json:"added,omitempty"`
+			Removed  []change  `json:"removed,omitempty"`
+			Modified []change  `json:"modified,omitempty"`
+			NAdd     int       `json:"numAdded"`
+			NRem     int       `json:"numRemoved"`
+			NMod     int       `json:"numModified"`
+		}{
+			Now:  now.In(time.UTC),
+			From: lhs, FromTime: lhsTime.In(time.UTC),
+			To: rhs, ToTime: rhsTime.In(time.UTC),
+			Added: added, Removed: removed, Modified: modified,
+			NAdd: len(added), NRem: len(removed), NMod: len(modified),
+		})
+		fmt.Println(string(bits))
+		return
+	}
+	for _, c := range added {
+		fmt.Println("+", c.Name)
+	}
+	for _, c := range removed {
+		fmt.Println("-", c.Name)
+	}
+	for _, c := range modified {
+		fmt.Println("M", c.Name)
+	}
+	fmt.Fprintf(os.Stderr, "-- %d added, %d removed, %d modified\n",
+		len(added), len(removed), len(modified))
+}
+
 func listArchives(_ *config.Config, as []tarsnap.Archive) {
 	var match []tarsnap.Archive
 	for _, arch := range as {
@@ -285,17 +681,102 @@ func listArchives(_ *config.Config, as []tarsnap.Archive) {
 	}
 }
 
-func effectiveNow() time.Time {
-	if *snapTime != "" {
-		et, err := time.ParseInLocation(timeFormat, *snapTime, time.Local)
+// errStopScan is a sentinel reported to end an entry scan early.
+var errStopScan = errors.New("stop scanning")
+
+// findEntry returns the entry for name in the specified archive, or nil if the
+// archive does not contain such an entry. A directory entry matches name with
+// or without a trailing slash.
+func findEntry(cfg *config.Config, arch, name string) (*tarsnap.Entry, error) {
+	name = strings.TrimSuffix(name, "/")
+	var found *tarsnap.Entry
+	err := cfg.Entries(arch, func(e *tarsnap.Entry) error {
+		if strings.TrimSuffix(e.Name, "/") == name {
+			found = e
+			return errStopScan
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errStopScan) {
+		return nil, err
+	}
+	return found, nil
+}
+
+// dumpPolicies prints the default expiration rules, the named policies, and
+// the rules in effect for the selected backup sets, in compact policy syntax.
+func dumpPolicies(cfg *config.Config) {
+	sets := cfg.Backup
+	if flag.NArg() != 0 {
+		var err error
+		sets, err = chooseBackups(cfg, flag.Args())
 		if err != nil {
-			log.Fatalf("Invalid time %q: %v", *snapTime, err)
+			log.Fatalf("Selecting backups: %v", err)
 		}
-		return et
 	}
-	return time.Now()
+	type setRules struct {
+		Set    string `json:"set"`
+		Policy string `json:"policy,omitempty"`
+		Rules  string `json:"rules"`
+	}
+	out := struct {
+		Default  string            `json:"default"`
+		Policies map[string]string `json:"policies,omitempty"`
+		Sets     []*setRules       `json:"sets"`
+	}{Default: cfg.Expiration.String()}
+	for name, rules := range cfg.Policy {
+		if out.Policies == nil {
+			out.Policies = make(map[string]string)
+		}
+		out.Policies[name] = rules.String()
+	}
+	for _, b := range sets {
+		out.Sets = append(out.Sets, &setRules{
+			Set:    b.Name,
+			Policy: b.Policy,
+			Rules:  cfg.EffectiveRules(b).String(),
+		})
+	}
+
+	if *doJSON {
+		bits, _ := json.Marshal(out)
+		fmt.Println(string(bits))
+		return
+	}
+	orNone := func(s string) string {
+		if s == "" {
+			return "(no expiration)"
+		}
+		return s
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 3, ' ', 0)
+	fmt.Fprint(tw, "(default)\t\t", orNone(out.Default), "\n")
+	for _, name := range slices.Sorted(maps.Keys(out.Policies)) {
+		fmt.Fprint(tw, "policy ", name, "\t\t", orNone(out.Policies[name]), "\n")
+	}
+	for _, s := range out.Sets {
+		fmt.Fprint(tw, s.Set, "\t", s.Policy, "\t", orNone(s.Rules), "\n")
+	}
+	tw.Flush()
 }
 
+// effectiveNow returns the effective current time, which is the wallclock time
+// unless -now is set. The value is computed once, so that relative times are
+// consistent throughout a run.
+var effectiveNow = sync.OnceValue(func() time.Time {
+	if *snapTime == "" {
+		return time.Now()
+	}
+	et, err := config.ParseTime(*snapTime, time.Now())
+	if err != nil {
+		log.Fatalf("Invalid time %q: %v", *snapTime, err)
+	}
+	if *doVerbose || *doVVerbose {
+		log.Printf("Effective time %q is %v", *snapTime, et.Format(time.RFC3339))
+	}
+	return et
+})
+
 func pruneArchives(cfg *config.Config, as []tarsnap.Archive) {
 	start := time.Now()   // actual time, for operation latency
 	now := effectiveNow() // effective time, for timestamp assignment
@@ -310,7 +791,42 @@ func pruneArchives(cfg *config.Config, as []tarsnap.Archive) {
 		}
 	}
 
+	if err := cfg.LoadPins(); err != nil {
+		log.Fatalf("Refusing to prune: %v", err)
+	}
+	if ba := cfg.BudgetArchives(as); len(ba) != 0 {
+		if err := cfg.LoadSizes(ba); err != nil {
+			log.Printf("[WARNING] Size budgets will not be applied: %v", err)
+		}
+	}
 	expired := cfg.FindExpired(chosen, now)
+	if err := cfg.CheckPruneClock(as, now); err != nil && !allowUnsafePrune("implausible clock", err) {
+		return
+	}
+	if err := cfg.CheckPruneLimits(chosen, expired); err != nil && !allowUnsafePrune("safety limits exceeded", err) {
+		return
+	}
+
+	// With a grace period, archives are deleted only once they have been
+	// pending for the grace period; newly-expired archives are marked.
+	var pending *config.PendingStore
+	if cfg.PruneGrace > 0 {
+		pending = new(config.PendingStore)
+		if err := pending.LoadFrom(cfg.PendingFile); err != nil {
+			log.Fatalf("Refusing to prune: loading pending deletions: %v", err)
+		}
+		var marked []tarsnap.Archive
+		expired, marked = pending.Update(chosen, expired, now, cfg.PruneGrace)
+		after := now.Add(time.Duration(cfg.PruneGrace) * time.Second)
+		verb := "Marked"
+		if *doDryRun {
+			verb = "Would mark"
+		}
+		for _, a := range marked {
+			fmt.Fprintf(os.Stderr, "-- %s %q for deletion after %s\n", verb, a.Name, after.Format(time.RFC3339))
+		}
+		savePending(cfg, pending)
+	}
 	exp := mapset.New[string]()
 	for _, e := range expired {
 		exp.Add(e.Name)
@@ -318,13 +834,26 @@ func pruneArchives(cfg *config.Config, as []tarsnap.Archive) {
 	prune := exp.Slice()
 	sort.Strings(prune)
 
+	// Ask for confirmation if this is an interactive prune, or if required.
+	ask := (*doPrune && isTerminal(os.Stdin) && isTerminal(os.Stderr)) || cfg.ConfirmPrune
 	if len(prune) == 0 {
 		fmt.Fprintln(os.Stderr, "Nothing to prune")
 		return
 	} else if *doDryRun {
 		fmt.Fprintln(os.Stderr, "-- Pruning would remove these archives:")
+	} else if ask && !confirmPrune(expired, now) {
+		fmt.Fprintln(os.Stderr, "Pruning cancelled")
+		return
 	} else if err := cfg.Config.Delete(prune...); err != nil {
 		log.Fatalf("Deleting archives: %v", err)
+	} else if pending != nil {
+		pending.Remove(prune...)
+		savePending(cfg, pending)
+	}
+	// For a dry run, estimate how much space the deletions would free.
+	var imp *impact
+	if *doDryRun {
+		imp = pruneImpact(expired, cfg.Config.Size, cfg.ArchiveSize)
 	}
 	elapsed := time.Since(start)
 	cfg.List() // repair the list cache
@@ -333,9 +862,27 @@ func pruneArchives(cfg *config.Config, as []tarsnap.Archive) {
 		bits, _ := json.Marshal(struct {
 			N time.Time         `json:"now"`
 			P []tarsnap.Archive `json:"pruned"`
+			I *impact           `json:"impact,omitempty"`
 			E time.Duration     `json:"elapsed"`
-		}{N: now.In(time.UTC), P: expired, E: elapsed})
+		}{N: now.In(time.UTC), P: expired, I: imp, E: elapsed})
 		fmt.Println(string(bits))
+	} else if imp != nil {
+		tw := tabwriter.NewWriter(os.Stdout, 0, 8, 3, ' ', 0)
+		for _, name := range prune {
+			if n, ok := imp.archive[name]; ok {
+				fmt.Fprint(tw, name, "\tfrees ", H(n), "\n")
+			} else {
+				fmt.Fprint(tw, name, "\tfrees ?\n")
+			}
+		}
+		tw.Flush()
+		fmt.Fprintln(os.Stderr, "-- Estimated space freed (compressed unique bytes):")
+		tw = tabwriter.NewWriter(os.Stdout, 0, 8, 3, ' ', 0)
+		for _, s := range imp.Sets {
+			fmt.Fprint(tw, s.Set, "\t", s.Archives, " archives\t", H(s.Bytes), "\n")
+		}
+		fmt.Fprint(tw, "TOTAL\t", len(prune), " archives\t", H(imp.Total), "\n")
+		tw.Flush()
 	} else {
 		fmt.Println(strings.Join(prune, "\n"))
 	}
@@ -348,87 +895,301 @@ func pruneArchives(cfg *config.Config, as []tarsnap.Archive) {
 	}
 }
 
-func restoreFiles(cfg *config.Config, dir string) {
-	if flag.NArg() == 0 {
-		log.Fatal("No paths were specified to -restore")
+// allowUnsafePrune reports whether pruning should proceed despite err, which
+// describes why it is unsafe. With -force, or for a dry run, pruning proceeds
+// with a warning. An auto-prune is skipped with a warning, leaving the
+// timestamp alone so that the prune is retried. Otherwise, it exits.
+func allowUnsafePrune(what string, err error) bool {
+	switch {
+	case *doForce:
+		log.Printf("[WARNING] Pruning anyway (-force), %s:\n%v", what, err)
+	case *doDryRun:
+		log.Printf("[WARNING] Pruning would be refused without -force, %s:\n%v", what, err)
+	case !*doPrune:
+		log.Printf("[WARNING] Refusing to prune, %s (use -force to override):\n%v", what, err)
+		return false
+	default:
+		log.Fatalf("Refusing to prune, %s (use -force to override):\n%v", what, err)
 	}
-	now := effectiveNow()
+	return true
+}
 
-	// Locate the backup set for each requested path.  For now this must be
-	// unique or it's an error.
-	need := make(map[string][]string) // :: base → paths
-	slow := mapset.New[string]()
-	for _, path := range flag.Args() {
-		abs, err := filepath.Abs(path)
-		if err != nil {
-			log.Fatalf("Unable to resolve %q: %v", path, err)
+// summarizePrune writes a summary of the archives to be pruned to w, grouped
+// by backup set, with the number of archives and the range of their ages.
+func summarizePrune(w io.Writer, expired []tarsnap.Archive, now time.Time) {
+	type group struct {
+		n              int
+		oldest, newest time.Time
+	}
+	groups := make(map[string]*group)
+	for _, a := range expired {
+		g := groups[a.Base]
+		if g == nil {
+			g = &group{oldest: a.Created, newest: a.Created}
+			groups[a.Base] = g
 		}
-		bs := cfg.FindPath(abs)
-		if len(bs) == 0 {
-			log.Fatalf("No backups found for %q", path)
-		} else if len(bs) > 1 {
-			log.Fatalf("Multiple backups found for %q", path)
+		g.n++
+		if a.Created.Before(g.oldest) {
+			g.oldest = a.Created
 		}
-		n := bs[0].Backup.Name
+		if a.Created.After(g.newest) {
+			g.newest = a.Created
+		}
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 3, ' ', 0)
+	fmt.Fprintln(tw, "SET\tCOUNT\tOLDEST\tNEWEST")
+	for _, set := range slices.Sorted(maps.Keys(groups)) {
+		g := groups[set]
+		fmt.Fprintf(tw, "%s\t%d\t%s (%s ago)\t%s (%s ago)\n", set, g.n,
+			g.oldest.In(time.Local).Format(time.DateOnly), age(now.Sub(g.oldest)),
+			g.newest.In(time.Local).Format(time.DateOnly), age(now.Sub(g.newest)))
+	}
+	tw.Flush()
+}
+
+// age renders d in days, or in hours if it is less than a day.
+func age(d time.Duration) string {
+	if d < 24*time.Hour {
+		return fmt.Sprintf("%dh", int(d.Hours()))
+	}
+	return fmt.Sprintf("%dd", int(d.Hours()/24))
+}
+
+// An impact estimates the storage freed by pruning archives.
+type impact struct {
+	Sets  []*setImpact `json:"sets"`
+	Total int64        `json:"total"` // compressed unique bytes
+
+	archive map[string]int64 // :: archive name → bytes freed
+}
+
+type setImpact struct {
+	Set      string `json:"set"`
+	Archives int    `json:"archives"`
+	Bytes    int64  `json:"bytes"` // compressed unique bytes
+}
 
-		// If possible, we'll use fast reads to avoid having to scan the whole
-		// archive.  But we can only do this if the user did not request the
-		// restoration of directories or globs.
-		if strings.HasSuffix(path, "/") || isGlob(path) {
-			slow.Add(n)
+// pruneImpact estimates the storage freed by deleting the expired archives,
+// as the sum of their compressed unique bytes. This is a lower bound, since
+// data shared only among the expired archives is not counted as unique to any
+// of them. Sizes are obtained by fetch (from tarsnap), or if that fails taken
+// from cached (the size cache) where possible.
+func pruneImpact(expired []tarsnap.Archive, fetch func(...string) (*tarsnap.SizeInfo, error), cached func(string) *tarsnap.Sizes) *impact {
+	names := make([]string, len(expired))
+	for i, a := range expired {
+		names[i] = a.Name
+	}
+	fmt.Fprintf(os.Stderr, "-- Estimating space freed by removing %d archives\n", len(names))
+	sizeOf := cached
+	if info, err := fetch(sortedUnique(names)...); err != nil {
+		log.Printf("[WARNING] Unable to fetch archive sizes: %v", err)
+	} else {
+		sizeOf = func(name string) *tarsnap.Sizes { return info.Archive[name] }
+	}
+
+	imp := &impact{archive: make(map[string]int64)}
+	sets := make(map[string]*setImpact)
+	seen := mapset.New[string]()
+	for _, a := range expired {
+		if seen.Has(a.Name) {
+			continue
 		}
-		need[n] = append(need[n], strings.TrimPrefix(bs[0].Relative, "/"))
+		seen.Add(a.Name)
+		s := sets[a.Base]
+		if s == nil {
+			s = &setImpact{Set: a.Base}
+			sets[a.Base] = s
+			imp.Sets = append(imp.Sets, s)
+		}
+		s.Archives++
+		if z := sizeOf(a.Name); z != nil {
+			imp.archive[a.Name] = z.CompressedUniqueBytes
+			s.Bytes += z.CompressedUniqueBytes
+			imp.Total += z.CompressedUniqueBytes
+		}
+	}
+	sort.Slice(imp.Sets, func(i, j int) bool { return imp.Sets[i].Set < imp.Sets[j].Set })
+	return imp
+}
 
-		// N.B.: snapback creates archives without -P, so absolute paths are
-		// trimmed by tarsnap when they are put into the archive. Removing the
-		// leading slash here ensures the query path to tarsnap matches.
+// confirmPrune summarizes the expired archives and asks the user to confirm
+// deleting them.
+func confirmPrune(expired []tarsnap.Archive, now time.Time) bool {
+	fmt.Fprintln(os.Stderr, "-- Pruning will remove these archives:")
+	summarizePrune(os.Stderr, expired, now)
+	return confirm(os.Stdin, fmt.Sprintf("Delete %d archives?", len(expired)))
+}
+
+// isTerminal reports whether f is connected to a terminal.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// confirm prints prompt to stderr and reports whether the user answered yes
+// on r. If r is exhausted, the answer is no.
+func confirm(r io.Reader, prompt string) bool {
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", prompt)
+	line, _ := bufio.NewReader(r).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(line)) {
+	case "y", "yes":
+		return true
 	}
+	return false
+}
 
-	// Now that we have something to restore, it's worth listing the archives.
-	fmt.Fprintln(os.Stderr, "-- Listing available archives")
-	as, err := cfg.List()
-	if err != nil {
-		log.Fatalf("Listing archives: %v", err)
+// savePending writes the pending deletions to the pending file, unless this
+// is a dry run.
+func savePending(cfg *config.Config, pending *config.PendingStore) {
+	if *doDryRun {
+		return
+	} else if err := pending.SaveTo(cfg.PendingFile); err != nil {
+		log.Fatalf("Saving pending deletions: %v", err)
 	}
+}
 
-	if err := os.MkdirAll(dir, 0700); err != nil {
-		log.Fatalf("Creating output directory: %v", err)
+// listPending lists the archives marked for deletion by pruning with a grace
+// period. With -cancel, it cancels the pending deletion of the archives named
+// by the non-flag arguments instead.
+func listPending(cfg *config.Config, cancel bool) {
+	if cfg.PendingFile == "" {
+		log.Fatal("No pending-file is configured")
+	}
+	var pending config.PendingStore
+	if err := pending.LoadFrom(cfg.PendingFile); err != nil {
+		log.Fatalf("Loading pending deletions: %v", err)
+	}
+	if cancel {
+		if flag.NArg() == 0 {
+			log.Fatal("No archives were specified to -cancel")
+		}
+		done := pending.Cancel(flag.Args()...)
+		if len(done) != flag.NArg() {
+			missing := mapset.New(flag.Args()...).RemoveAll(mapset.New(done...))
+			log.Printf("[WARNING] Not pending deletion: %s", strings.Join(missing.Slice(), ", "))
+		}
+		savePending(cfg, &pending)
+		if *doJSON {
+			bits, _ := json.Marshal(struct {
+				C []string `json:"cancelled"`
+				D bool     `json:"dryRun,omitempty"`
+			}{C: done, D: *doDryRun})
+			fmt.Println(string(bits))
+		} else {
+			for _, name := range done {
+				fmt.Println(name)
+			}
+		}
+		return
 	}
 
-	for set, paths := range need {
-		opts := tarsnap.ExtractOptions{
-			Include:            sortedUnique(paths),
-			WorkDir:            dir,
-			RestorePermissions: true,
-			FastRead:           !slow.Has(set),
+	grace := time.Duration(cfg.PruneGrace) * time.Second
+	if *doJSON {
+		type entry struct {
+			*config.Pending
+			Due time.Time `json:"due"`
 		}
+		out := []entry{}
+		for _, p := range pending.Pending {
+			out = append(out, entry{Pending: p, Due: p.Marked.Add(grace)})
+		}
+		bits, _ := json.Marshal(out)
+		fmt.Println(string(bits))
+		return
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 3, ' ', 0)
+	fmt.Fprintln(tw, "ARCHIVE\tMARKED\tDUE")
+	for _, p := range pending.Pending {
+		fmt.Fprint(tw, p.Archive, "\t", p.Marked.In(time.Local).Format(time.RFC3339),
+			"\t", p.Marked.Add(grace).In(time.Local).Format(time.RFC3339), "\n")
+	}
+	tw.Flush()
+}
 
-		// Find the latest archive and run the extraction.
-		arch, ok := tarsnap.Archives(as).LatestAsOf(set, now)
-		if !ok {
-			log.Fatalf("Unable to find the latest %q archive", set)
+// pinArchives pins (or, if unpin is true, unpins) the archives named by the
+// non-flag arguments in the pin file. With no arguments, it lists the pinned
+// archives.
+func pinArchives(cfg *config.Config, as tarsnap.Archives, unpin bool) {
+	var ps config.PinStore
+	if cfg.PinFile != "" {
+		if err := ps.LoadFrom(cfg.PinFile); err != nil {
+			log.Fatalf("Loading pins: %v", err)
 		}
-		fmt.Fprintf(os.Stderr, "-- Restoring from %q\n » %s\n",
-			arch.Name, strings.Join(opts.Include, "\n » "))
-		if *doDryRun {
-			fmt.Fprintln(os.Stderr, "[dry run, not restoring]")
-		} else if err := cfg.Config.Extract(arch.Name, opts); err != nil {
-			log.Fatalf("Extracting from %q: %v", arch.Name, err)
+	}
+	if flag.NArg() == 0 {
+		pins := ps.Pins
+		for _, name := range cfg.Pinned {
+			pins = append(pins, &config.Pin{Archive: name})
+		}
+		sort.Slice(pins, func(i, j int) bool { return pins[i].Archive < pins[j].Archive })
+		if *doJSON {
+			bits, _ := json.Marshal(pins)
+			fmt.Println(string(bits))
+			return
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 8, 3, ' ', 0)
+		for _, p := range pins {
+			when := "config"
+			if !p.Pinned.IsZero() {
+				when = p.Pinned.In(time.Local).Format(time.RFC3339)
+			}
+			fmt.Fprint(tw, p.Archive, "\t", when, "\n")
+		}
+		tw.Flush()
+		return
+	} else if cfg.PinFile == "" {
+		log.Fatal("No pin-file is configured")
+	}
+
+	now := effectiveNow()
+	var changed []string
+	for _, name := range resolveArchives(as, flag.Args()) {
+		if unpin {
+			if slices.Contains(cfg.Pinned, name) {
+				log.Printf("[WARNING] %q is pinned by the configuration file", name)
+			}
+			if ps.Remove(name) {
+				changed = append(changed, name)
+			}
+			continue
+		}
+		if !slices.ContainsFunc(as, func(a tarsnap.Archive) bool { return a.Name == name }) {
+			log.Fatalf("Archive %q not found", name)
+		} else if ps.Add(name, now) {
+			changed = append(changed, name)
+		}
+	}
+	if *doDryRun {
+		fmt.Fprintln(os.Stderr, "[dry run, not updating pins]")
+	} else if err := ps.SaveTo(cfg.PinFile); err != nil {
+		log.Fatalf("Saving pins: %v", err)
+	}
+	if *doJSON {
+		bits, _ := json.Marshal(struct {
+			P []string `json:"changed"`
+			U bool     `json:"unpin,omitempty"`
+			D bool     `json:"dryRun,omitempty"`
+		}{P: changed, U: unpin, D: *doDryRun})
+		fmt.Println(string(bits))
+	} else {
+		for _, name := range changed {
+			fmt.Println(name)
 		}
 	}
 }
 
 func printSizes(cfg *config.Config, as []tarsnap.Archive) {
 	var names []string
+	args := resolveArchives(as, flag.Args())
 
 	// If we have no archive list, it means the command-line arguments name
 	// specific archives to size.
 	if len(as) == 0 {
-		names = flag.Args()
+		names = args
 	} else {
 		// Otherwise, we need to filter the archive list with flag globs.
 		for _, a := range as {
-			if matchExpr(a.Name, flag.Args()) {
+			if matchExpr(a.Name, args) {
 				names = append(names, a.Name)
 			}
 		}
@@ -535,6 +1296,8 @@ func createBackups(cfg *config.Config, names []string) ([]string, error) {
 	tag := "." + ts.Format("20060102-1504")
 	nerrs := 0
 	var created []string
+	man := &config.Manifest{Version: toolVersion(), Created: ts, Config: cfg}
+	man.Host, _ = os.Hostname()
 	for _, b := range sets {
 		b.ExpandIncludes(cfg.WorkDir)
 		opts := b.CreateOptions
@@ -544,6 +1307,23 @@ func createBackups(cfg *config.Config, names []string) ([]string, error) {
 		if err := cfg.Config.Create(name, opts); err != nil {
 			log.Printf("ERROR: %s: %v", name, err)
 			nerrs++
+		} else {
+			if !*doJSON {
+				fmt.Println(name)
+			}
+			ms := &config.ManifestSet{Name: b.Name, Archive: name, CreateOptions: opts}
+			if ms.WorkDir = b.Dir(cfg.WorkDir); !filepath.IsAbs(ms.WorkDir) {
+				ms.WorkDir = filepath.Join(cfg.WorkDir, ms.WorkDir)
+			}
+			man.Sets = append(man.Sets, ms)
+		}
+		created = append(created, name)
+	}
+	if cfg.Manifest != "" && len(man.Sets) != 0 {
+		name := cfg.Manifest + tag
+		if err := createManifest(cfg, name, man); err != nil {
+			log.Printf("ERROR: %s: %v", name, err)
+			nerrs++
 		} else if !*doJSON {
 			fmt.Println(name)
 		}
@@ -555,6 +1335,101 @@ func createBackups(cfg *config.Config, names []string) ([]string, error) {
 	return created, nil
 }
 
+// createManifest creates an archive with the specified name containing the
+// manifest and a copy of the configuration file.
+func createManifest(cfg *config.Config, name string, man *config.Manifest) error {
+	dir, err := os.MkdirTemp("", "snapback-manifest-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	bits, err := json.MarshalIndent(man, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding manifest: %v", err)
+	} else if err := os.WriteFile(filepath.Join(dir, config.ManifestFile), bits, 0600); err != nil {
+		return err
+	} else if err := os.WriteFile(filepath.Join(dir, config.ManifestConfigFile), configText, 0600); err != nil {
+		return err
+	}
+	return cfg.Config.Create(name, tarsnap.CreateOptions{
+		Include:      []string{config.ManifestFile, config.ManifestConfigFile},
+		WorkDir:      dir,
+		CreationTime: man.Created,
+		DryRun:       *doDryRun,
+	})
+}
+
+// toolVersion reports the module version of the running program.
+func toolVersion() string {
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		return bi.Main.Version
+	}
+	return "unknown"
+}
+
+// tarsnapCommand returns a command to run the tarsnap tool with the specified
+// arguments, using the settings from ts. Unlike the methods of ts, the command
+// does not capture the output of the tool.
+//
+// The tarsnap package does not export how it constructs its commands, so the
+// arguments are built here in the same way: This must be kept in sync with the
+// unexported base and addFlags methods of tarsnap.Config.
+//
+// TODO: Add extraction to an io.Writer to the tarsnap package, and use that
+// for -cat instead of this function and flagAppliesTo.
+func tarsnapCommand(ts *tarsnap.Config, args ...string) *exec.Cmd {
+	tool := "tarsnap"
+	if ts.Tool != "" {
+		tool = ts.Tool
+	}
+	base := []string{"--quiet", "--no-print-stats"}
+	for _, f := range ts.Flags {
+		if !flagAppliesTo(ts, f, args) {
+			continue
+		}
+		key := "--" + f.Flag
+		switch v := f.Value.(type) {
+		case nil:
+			base = append(base, key)
+		case bool:
+			if v {
+				base = append(base, key)
+			} else {
+				base = append(base, "--no-"+f.Flag)
+			}
+		case string:
+			base = append(base, key, os.ExpandEnv(v))
+		case float64:
+			base = append(base, key, strconv.FormatFloat(v, 'g', -1, 64))
+		default: // e.g., arrays, objects, null
+			log.Printf("WARNING: Ignored invalid value for flag %q: %v", f.Flag, f.Value)
+		}
+	}
+	if ts.Keyfile != "" {
+		base = append(base, "--keyfile", ts.Keyfile)
+	}
+	if ts.CacheDir != "" {
+		base = append(base, "--cachedir", ts.CacheDir)
+	}
+	args = append(base, args...)
+	logCommand(tool, args)
+	return exec.Command(tool, args...)
+}
+
+// flagAppliesTo reports whether f should be passed to tarsnap with args, as
+// the tarsnap package does. A matched keyfile or cachedir flag is superseded
+// by the corresponding setting of ts.
+func flagAppliesTo(ts *tarsnap.Config, f tarsnap.Flag, args []string) bool {
+	if f.Match == "" {
+		return true
+	}
+	if (f.Flag == "keyfile" && ts.Keyfile != "") || (f.Flag == "cachedir" && ts.CacheDir != "") {
+		return false
+	}
+	return slices.Contains(args, f.Match)
+}
+
 func checkUpdate() {
 	fmt.Fprintf(os.Stderr, "-- Updating %s from the network\n", toolPackage)
 	cmd := exec.Command("go", "install", toolPackage+"@latest")
@@ -579,18 +1454,18 @@ func matchExpr(name string, exprs []string) bool {
 
 func loadConfig(path string) (string, *config.Config, error) {
 	exp := os.ExpandEnv(path)
-	f, err := static.Open(exp)
+	data, err := fs.ReadFile(static, exp)
 	if errors.Is(err, fs.ErrNotExist) {
-		f, err = os.Open(exp)
+		data, err = os.ReadFile(exp)
 	}
 	if err != nil {
 		return "", nil, err
 	}
-	defer f.Close()
-	cfg, err := config.Parse(f)
+	cfg, err := config.Parse(bytes.NewReader(data))
 	if err != nil {
 		return "", nil, err
 	}
+	configText = data
 	loc, err := filepath.Abs(exp)
 	if err != nil {
 		return "", nil, err
@@ -640,6 +1515,44 @@ func hasGlob(args []string) bool {
 	return slices.ContainsFunc(args, isGlob)
 }
 
+func hasSelector(args []string) bool {
+	return slices.ContainsFunc(args, config.IsSelector)
+}
+
+// resolveArchives returns a copy of args in which each archive selector is
+// replaced by the name of the archive it denotes in as. Other arguments,
+// including selectors that exactly match an archive name, are copied
+// unchanged.
+func resolveArchives(as tarsnap.Archives, args []string) []string {
+	out := make([]string, len(args))
+	for i, arg := range args {
+		if !config.IsSelector(arg) {
+			out[i] = arg
+		} else {
+			out[i] = resolveArchive(as, arg).Name
+		}
+	}
+	return out
+}
+
+// resolveArchive returns the archive in as denoted by the specified archive
+// name or selector. If spec is exactly the name of an archive in as, that
+// archive is chosen, even if spec also has the syntax of a selector.
+func resolveArchive(as tarsnap.Archives, spec string) tarsnap.Archive {
+	if i := slices.IndexFunc(as, func(a tarsnap.Archive) bool { return a.Name == spec }); i >= 0 {
+		return as[i]
+	}
+	sel, err := config.ParseSelector(spec)
+	if err != nil {
+		log.Fatalf("Invalid selector: %v", err)
+	}
+	arch, err := sel.Resolve(as, effectiveNow())
+	if err != nil {
+		log.Fatalf("Resolving %q: %v", spec, err)
+	}
+	return arch
+}
+
 func sortedUnique(ss []string) []string {
 	out := mapset.New(ss...).Slice()
 	sort.Strings(out)
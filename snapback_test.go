@@ -0,0 +1,174 @@
+// Copyright (C) 2018 Michael J. Fromberger. All Rights Reserved.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/creachadair/tarsnap"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestTarsnapCommand(t *testing.T) {
+	ts := &tarsnap.Config{
+		Tool:    "/bin/tarsnap",
+		Keyfile: "/key",
+		Flags: []tarsnap.Flag{
+			{Flag: "humanize-numbers"},
+			{Flag: "print-stats", Value: false},
+			{Flag: "maxbw-rate", Value: 100.0, Match: "-x"},
+			{Flag: "checkpoint-bytes", Value: 1e9, Match: "-c"}, // not matched
+			{Flag: "keyfile", Value: "/other", Match: "-x"},     // superseded
+			{Flag: "bogus", Value: []any{1}},                    // ignored
+		},
+	}
+	cmd := tarsnapCommand(ts, "-x", "-f", "arch")
+	want := []string{
+		"/bin/tarsnap", "--quiet", "--no-print-stats",
+		"--humanize-numbers", "--no-print-stats", "--maxbw-rate", "100",
+		"--keyfile", "/key", "-x", "-f", "arch",
+	}
+	if diff := cmp.Diff(want, cmd.Args); diff != "" {
+		t.Errorf("Wrong arguments: (-want, +got)\n%s", diff)
+	}
+}
+
+func TestResolveArchives(t *testing.T) {
+	t0 := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	as := tarsnap.Archives{
+		{Name: "docs.1", Base: "docs", Created: t0},
+		{Name: "user@host.2024", Base: "user@host", Created: t0.Add(time.Hour)},
+		{Name: "docs.2", Base: "docs", Created: t0.Add(2 * time.Hour)},
+		{Name: "a~2.x", Base: "a~2", Created: t0.Add(3 * time.Hour)},
+	}
+	args := []string{"docs~2", "user@host.2024", "docs@latest", "a~2.x", "other"}
+	want := []string{"docs.1", "user@host.2024", "docs.2", "a~2.x", "other"}
+	if diff := cmp.Diff(want, resolveArchives(as, args)); diff != "" {
+		t.Errorf("Wrong archives: (-want, +got)\n%s", diff)
+	}
+
+	for _, test := range []struct{ name, want string }{
+		{"docs.1", "docs"},
+		{"docs@latest", "docs"},
+		{"user@host.2024", "user@host"}, // not a valid selector
+		{"a~2.x", "a~2"},                // not a valid selector
+	} {
+		if got := archiveBase(test.name); got != test.want {
+			t.Errorf("archiveBase(%q): got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSummarizePrune(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.Local)
+	ago := func(d time.Duration) time.Time { return now.Add(-d) }
+	const day = 24 * time.Hour
+	expired := []tarsnap.Archive{
+		{Name: "pics.2", Base: "pics", Created: ago(3 * time.Hour)},
+		{Name: "docs.1", Base: "docs", Created: ago(30 * day)},
+		{Name: "docs.3", Base: "docs", Created: ago(2 * day)},
+		{Name: "docs.2", Base: "docs", Created: ago(10 * day)},
+	}
+	var buf bytes.Buffer
+	summarizePrune(&buf, expired, now)
+
+	// Sets are sorted by name, and each reports its count and age range.
+	want := [][]string{
+		{"SET", "COUNT", "OLDEST", "NEWEST"},
+		{"docs", "3", "2024-05-02", "(30d", "ago)", "2024-05-30", "(2d", "ago)"},
+		{"pics", "1", "2024-06-01", "(3h", "ago)", "2024-06-01", "(3h", "ago)"},
+	}
+	var got [][]string
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		got = append(got, strings.Fields(line))
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Wrong summary: (-want, +got)\n%s", diff)
+	}
+}
+
+func TestConfirm(t *testing.T) {
+	tests := []struct {
+		input string
+		want  bool
+	}{
+		{"y\n", true},
+		{"yes\n", true},
+		{"  Y \n", true},
+		{"YES", true}, // no newline before EOF
+		{"n\n", false},
+		{"no\n", false},
+		{"\n", false},
+		{"yep\n", false},
+		{"", false}, // EOF
+	}
+	for _, test := range tests {
+		if got := confirm(strings.NewReader(test.input), "OK?"); got != test.want {
+			t.Errorf("confirm(%q): got %v, want %v", test.input, got, test.want)
+		}
+	}
+}
+
+func TestPruneImpact(t *testing.T) {
+	expired := []tarsnap.Archive{
+		{Name: "docs.1", Base: "docs"},
+		{Name: "pics.1", Base: "pics"},
+		{Name: "docs.2", Base: "docs"},
+		{Name: "docs.1", Base: "docs"}, // listed twice, counted once
+		{Name: "docs.3", Base: "docs"}, // size unknown
+	}
+	sizes := map[string]*tarsnap.Sizes{
+		"docs.1": {CompressedUniqueBytes: 100},
+		"docs.2": {CompressedUniqueBytes: 20},
+		"pics.1": {CompressedUniqueBytes: 5},
+	}
+	cached := map[string]*tarsnap.Sizes{
+		"docs.1": {CompressedUniqueBytes: 1},
+		"pics.1": {CompressedUniqueBytes: 2},
+	}
+
+	check := func(t *testing.T, imp *impact, want *impact) {
+		t.Helper()
+		opt := cmp.AllowUnexported(impact{})
+		if diff := cmp.Diff(want, imp, opt); diff != "" {
+			t.Errorf("Wrong impact: (-want, +got)\n%s", diff)
+		}
+	}
+
+	t.Run("Fetched", func(t *testing.T) {
+		var asked []string
+		fetch := func(names ...string) (*tarsnap.SizeInfo, error) {
+			asked = names
+			return &tarsnap.SizeInfo{Archive: sizes}, nil
+		}
+		imp := pruneImpact(expired, fetch, func(name string) *tarsnap.Sizes { return cached[name] })
+		if diff := cmp.Diff([]string{"docs.1", "docs.2", "docs.3", "pics.1"}, asked); diff != "" {
+			t.Errorf("Wrong archives fetched: (-want, +got)\n%s", diff)
+		}
+		check(t, imp, &impact{
+			Sets: []*setImpact{
+				{Set: "docs", Archives: 3, Bytes: 120},
+				{Set: "pics", Archives: 1, Bytes: 5},
+			},
+			Total:   125,
+			archive: map[string]int64{"docs.1": 100, "docs.2": 20, "pics.1": 5},
+		})
+	})
+
+	t.Run("Cached", func(t *testing.T) {
+		fetch := func(...string) (*tarsnap.SizeInfo, error) { return nil, errors.New("offline") }
+		imp := pruneImpact(expired, fetch, func(name string) *tarsnap.Sizes { return cached[name] })
+		check(t, imp, &impact{
+			Sets: []*setImpact{
+				{Set: "docs", Archives: 3, Bytes: 1},
+				{Set: "pics", Archives: 1, Bytes: 2},
+			},
+			Total:   3,
+			archive: map[string]int64{"docs.1": 1, "pics.1": 2},
+		})
+	})
+}
@@ -0,0 +1,124 @@
+// Copyright (C) 2018 Michael J. Fromberger. All Rights Reserved.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/creachadair/snapback/config"
+	"github.com/creachadair/tarsnap"
+)
+
+// A discrepancy records a difference between a restored file and the archive
+// entry it was restored from.
+type discrepancy struct {
+	Entry   string `json:"entry"`
+	Path    string `json:"path"`
+	Problem string `json:"problem"`
+}
+
+func (d discrepancy) String() string {
+	return fmt.Sprintf("%s: %s (from %q)", d.Path, d.Problem, d.Entry)
+}
+
+// verifyEntries compares the files restored from the named archive against
+// the metadata of its entries. The locate function returns the path to which
+// an entry was restored, or "" if the entry was not restored.
+func verifyEntries(cfg *config.Config, name string, locate func(*tarsnap.Entry) string) ([]discrepancy, error) {
+	fmt.Fprintf(os.Stderr, "-- Verifying files restored from %q\n", name)
+	var out []discrepancy
+	err := cfg.Entries(name, func(e *tarsnap.Entry) error {
+		if path := locate(e); path != "" {
+			if d, ok := verifyFile(e, path); !ok {
+				out = append(out, d)
+			}
+		}
+		return nil
+	})
+	return out, err
+}
+
+// verifyFile compares the file at path against the archive entry e, and
+// reports whether they match. If not, it describes the discrepancy.
+//
+// Regular files are checked for size, mode, and modification time. Only the
+// type of directories and symbolic links is checked, since extracting the
+// contents of a directory may change its modification time.
+func verifyFile(e *tarsnap.Entry, path string) (discrepancy, bool) {
+	d := discrepancy{Entry: e.Name, Path: path}
+	fi, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		d.Problem = "missing"
+		return d, false
+	} else if err != nil {
+		d.Problem = err.Error()
+		return d, false
+	}
+
+	const mask = fs.ModeType | fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky
+	var probs []string
+	if got, want := fi.Mode().Type(), e.Mode.Type(); got != want {
+		probs = append(probs, fmt.Sprintf("type is %v, want %v", got, want))
+	} else if want.IsRegular() {
+		if got, want := fi.Size(), e.Size; got != want {
+			probs = append(probs, fmt.Sprintf("size is %d, want %d", got, want))
+		}
+		if got, want := fi.Mode()&mask, e.Mode&mask; got != want {
+			probs = append(probs, fmt.Sprintf("mode is %v, want %v", got, want))
+		}
+		// Archive timestamps have a resolution of one second.
+		if got, want := fi.ModTime().Truncate(time.Second), e.ModTime; !got.Equal(want) {
+			probs = append(probs, fmt.Sprintf("modified %v, want %v",
+				got.Format(time.RFC3339), want.In(time.Local).Format(time.RFC3339)))
+		}
+	}
+	if len(probs) == 0 {
+		return d, true
+	}
+	d.Problem = strings.Join(probs, "; ")
+	return d, false
+}
+
+// reportMismatches logs the discrepancies found by verification, if any, and
+// exits with an error if there are any.
+func reportMismatches(bad []discrepancy) {
+	if !*doVerify || *doDryRun {
+		return
+	}
+	for _, d := range bad {
+		fmt.Fprintln(os.Stderr, "MISMATCH", d)
+	}
+	if len(bad) != 0 {
+		log.Fatalf("Verification failed: %d restored files do not match the archive", len(bad))
+	}
+	fmt.Fprintln(os.Stderr, "-- Verification passed")
+}
+
+// matchesInclude reports whether the archive entry name is selected by one of
+// the include paths or globs given to an extraction.
+func matchesInclude(name string, include []string) bool {
+	for _, p := range include {
+		p = strings.TrimSuffix(p, "/")
+		if name == p || strings.HasPrefix(name, p+"/") {
+			return true
+		} else if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// restoredPath returns the path to which the archive entry name of backup b
+// was restored under root, after relocation.
+func restoredPath(root string, b *config.Backup, name string) string {
+	local, _ := b.LocalName(name)
+	return filepath.Join(root, strings.TrimLeft(local, "/"))
+}
@@ -0,0 +1,126 @@
+// Copyright (C) 2018 Michael J. Fromberger. All Rights Reserved.
+
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/creachadair/snapback/config"
+	"github.com/creachadair/tarsnap"
+)
+
+func TestVerifyFile(t *testing.T) {
+	dir := t.TempDir()
+	mtime := time.Date(2024, 5, 1, 8, 30, 0, 0, time.UTC)
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, []byte("hello"), 0640); err != nil {
+		t.Fatal(err)
+	} else if err := os.Chtimes(file, mtime, mtime.Add(500*time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	sub := filepath.Join(dir, "sub")
+	if err := os.Mkdir(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink("file", link); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		path string
+		e    tarsnap.Entry
+		want string // problem, or "" if the file matches
+	}{
+		{"match", file,
+			tarsnap.Entry{Mode: 0640, Size: 5, ModTime: mtime}, ""},
+		{"size", file,
+			tarsnap.Entry{Mode: 0640, Size: 6, ModTime: mtime}, "size is 5, want 6"},
+		{"mode", file,
+			tarsnap.Entry{Mode: 0644, Size: 5, ModTime: mtime}, "mode is -rw-r-----, want -rw-r--r--"},
+		{"mtime", file,
+			tarsnap.Entry{Mode: 0640, Size: 5, ModTime: mtime.Add(time.Second)}, "modified "},
+		{"several", file,
+			tarsnap.Entry{Mode: 0600, Size: 1, ModTime: mtime}, "size is 5, want 1; mode is"},
+		{"missing", filepath.Join(dir, "nonesuch"),
+			tarsnap.Entry{Mode: 0640, Size: 5, ModTime: mtime}, "missing"},
+		{"type", file,
+			tarsnap.Entry{Mode: fs.ModeDir | 0755}, "type is ----------, want d---------"},
+
+		// Only the type of directories and symlinks is checked.
+		{"dir", sub,
+			tarsnap.Entry{Mode: fs.ModeDir | 0700, Size: 99, ModTime: mtime}, ""},
+		{"link", link,
+			tarsnap.Entry{Mode: fs.ModeSymlink | 0777, ModTime: mtime}, ""},
+		{"link not dir", link,
+			tarsnap.Entry{Mode: fs.ModeDir | 0755}, "type is L---------, want d---------"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.e.Name = "entry"
+			d, ok := verifyFile(&test.e, test.path)
+			if ok != (test.want == "") {
+				t.Errorf("verifyFile: got (%q, %v), want ok=%v", d.Problem, ok, test.want == "")
+			}
+			if !strings.HasPrefix(d.Problem, test.want) {
+				t.Errorf("verifyFile: got problem %q, want prefix %q", d.Problem, test.want)
+			}
+			if d.Entry != "entry" || d.Path != test.path {
+				t.Errorf("verifyFile: got entry %q path %q, want %q, %q", d.Entry, d.Path, "entry", test.path)
+			}
+		})
+	}
+}
+
+func TestMatchesInclude(t *testing.T) {
+	include := []string{"docs/", "src/main.go", "pics/*.jpg"}
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"docs", true},
+		{"docs/a.txt", true},
+		{"docs/sub/b.txt", true},
+		{"docs-old/a.txt", false}, // a prefix, but not a path prefix
+		{"src/main.go", true},
+		{"src/main.go.orig", false},
+		{"src/other.go", false},
+		{"pics/cat.jpg", true},
+		{"pics/cat.png", false},
+		{"pics/sub/cat.jpg", false}, // glob * does not match "/"
+		{"other", false},
+	}
+	for _, test := range tests {
+		if got := matchesInclude(test.name, include); got != test.want {
+			t.Errorf("matchesInclude(%q): got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestRestoredPath(t *testing.T) {
+	b := &config.Backup{
+		Name: "test",
+		CreateOptions: tarsnap.CreateOptions{
+			Include: []string{"src", "/etc"},
+			Modify:  []string{`/^src/src-old/`},
+		},
+	}
+	tests := []struct {
+		name, want string
+	}{
+		{"src-old/a.go", "/r/src/a.go"}, // relocated to its original path
+		{"etc/hosts", "/r/etc/hosts"},   // absolute, leading "/" not doubled
+		{"other/x", "/r/other/x"},       // unaffected by any rule
+	}
+	for _, test := range tests {
+		if got := restoredPath("/r", b, test.name); got != test.want {
+			t.Errorf("restoredPath(%q): got %q, want %q", test.name, got, test.want)
+		}
+	}
+}